@@ -0,0 +1,125 @@
+package geobed
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Where the data archive set with WithDataArchive() is read from. A URL is downloaded into the data directory.
+func (cfg config) archivePath() string {
+	if u, err := url.Parse(cfg.dataArchive); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return cfg.dataPath(path.Base(u.Path))
+	}
+	return cfg.dataArchive
+}
+
+// Reads the data set files out of a tar archive (optionally gzipped), keyed by data set id. Files are matched to data sets by their name
+// without extensions, so the archive can have "cities1000.zip" or just "cities1000.txt". The files are kept as they are in the archive
+// (ie. still zipped) until they're loaded.
+func readDataArchive(archivePath string) (map[string][]byte, error) {
+	fi, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	var r io.Reader = bufio.NewReader(fi)
+	if magic, _ := r.(*bufio.Reader).Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		fz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer fz.Close()
+		r = fz
+	}
+
+	stems := map[string]string{}
+	for _, f := range dataSetFiles {
+		stems[fileStem(f["path"])] = f["id"]
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, ok := stems[fileStem(h.Name)]
+		if !ok || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[id] = b
+	}
+	return files, nil
+}
+
+// A file's name without its directory or any extensions, ie. "worldcitiespop" for "./geobed-data/worldcitiespop.txt.gz".
+func fileStem(name string) string {
+	name = path.Base(name)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// Loads a data set from a file read out of the data archive, which may be zipped or gzipped.
+func (g *GeoBed) loadArchivedDataSet(id string, b []byte) error {
+	if bytes.HasPrefix(b, zipMagic) {
+		rz, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return err
+		}
+		for _, uF := range rz.File {
+			fi, err := uF.Open()
+			if err != nil {
+				return err
+			}
+			g.loadDataSet(id, fi)
+			fi.Close()
+		}
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(b, gzipMagic) {
+		fz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer fz.Close()
+		r = fz
+	}
+	g.loadDataSet(id, r)
+	return nil
+}
+
+// Passes a data set to its loader.
+func (g *GeoBed) loadDataSet(id string, r io.Reader) {
+	switch id {
+	case "geonamesCities1000":
+		g.loadGeonamesCities(r)
+	case "maxmindWorldCities":
+		g.loadMaxMindCities(r)
+	case "geonamesCountryInfo":
+		g.loadGeonamesCountryInfo(r)
+	case "geonamesAdmin1Codes":
+		g.loadGeonamesAdmin1Codes(r)
+	}
+}
@@ -0,0 +1,151 @@
+package geobed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Geocodes many location strings at once, spreading the work across a number of goroutines. The results are in the same order as the queries.
+// If workers is less than 1, the number set with WithWorkers() is used, which defaults to the number of CPUs.
+func (g *GeoBed) GeocodeBatch(queries []string, workers int, opts ...GeocodeOptions) []GeobedCity {
+	results := make([]GeobedCity, len(queries))
+	g.parallel(len(queries), workers, func(i int) {
+		results[i] = g.Geocode(queries[i], opts...)
+	})
+	return results
+}
+
+// Reverse geocodes many lat/lng pairs at once, spreading the work across a number of goroutines. The results are in the same order as the
+// coordinates. If workers is less than 1, the number set with WithWorkers() is used, which defaults to the number of CPUs.
+func (g *GeoBed) ReverseGeocodeBatch(coords [][2]float64, workers int) []GeobedCity {
+	results := make([]GeobedCity, len(coords))
+	g.parallel(len(coords), workers, func(i int) {
+		results[i] = g.ReverseGeocode(coords[i][0], coords[i][1])
+	})
+	return results
+}
+
+// Calls fn for 0 through n-1 from a pool of goroutines, returning when they're all done.
+func (g *GeoBed) parallel(n int, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = g.cfg.workers
+	}
+	if workers < 1 {
+		// NOTE: In containers with a CPU limit, this can be more CPUs than are really available. Use WithWorkers() there.
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+
+	// Each goroutine takes the next index from a shared counter rather than a channel. Lookups only take a read lock, so with millions
+	// of queries handing out the work was what kept the batch from scaling with the number of CPUs.
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < n; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// How many lines GeocodeFileResumable() geocodes before writing them out. Each chunk that's written is a checkpoint.
+const resumableChunkSize = 1000
+
+// Geocodes a file with one location string per line, writing a CSV line to the output file for each (query, city, region, country, latitude, longitude).
+// Results are written and synced to disk in chunks. If the output file already exists, the lines it already has results for are skipped,
+// so an interrupted job can be restarted without geocoding everything again. An unfinished line at the end of the output (ie. from a crash) is discarded.
+func (g *GeoBed) GeocodeFileResumable(inPath string, outPath string) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	done, err := resumeOutput(out)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	line := 0
+	chunk := make([]string, 0, resumableChunkSize)
+	flush := func() error {
+		results := g.GeocodeBatch(chunk, 0)
+		for i, c := range results {
+			rec := []string{chunk[i], c.City, c.Region, c.Country, "", ""}
+			if c.City != "" {
+				rec[4] = strconv.FormatFloat(c.Latitude, 'f', -1, 64)
+				rec[5] = strconv.FormatFloat(c.Longitude, 'f', -1, 64)
+			}
+			w.Write(rec)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return out.Sync()
+	}
+	for scanner.Scan() {
+		line++
+		if line <= done {
+			continue
+		}
+		chunk = append(chunk, scanner.Text())
+		if len(chunk) == resumableChunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(chunk) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// Counts the complete lines in a GeocodeFileResumable() output file, truncating anything after the last one, and leaves the file positioned at the end.
+func resumeOutput(out *os.File) (int, error) {
+	done := 0
+	var size int64
+	r := bufio.NewReader(out)
+	for {
+		l, err := r.ReadBytes('\n')
+		// Whatever is left without a newline is an unfinished line.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(l))
+		done++
+	}
+	if err := out.Truncate(size); err != nil {
+		return 0, err
+	}
+	_, err := out.Seek(size, io.SeekStart)
+	return done, err
+}
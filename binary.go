@@ -0,0 +1,314 @@
+package geobed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+)
+
+// The format used to store the city and country data in the cache.
+type CacheFormat uint8
+
+const (
+	// Go's gob encoding (the default). It's tied to the GeobedCity and CountryInfo struct definitions and can only be read by Go.
+	CacheGob CacheFormat = iota
+	// A versioned flat binary format with an explicit field order (see below), so it can be read by other languages and library versions.
+	CacheBinary
+)
+
+// The flat binary format is laid out as:
+//
+//	magic     6 bytes, "GEOBED"
+//	version   uint16
+//	kind      uint8, 1 for cities and 2 for countries
+//	count     uint32, the number of records that follow
+//	records   count records, each with its fields written in the order listed by writeCity() and writeCountry()
+//
+// All numbers are little endian. Strings are a uint32 byte length followed by UTF-8 bytes and floats are IEEE 754.
+// Fields are only ever appended to records, with the version bumped, so a reader knows which fields to expect.
+const binaryVersion uint16 = 4
+
+var binaryMagic = []byte("GEOBED")
+
+const (
+	binaryKindCities  uint8 = 1
+	binaryKindCountry uint8 = 2
+)
+
+// Writes values in the flat binary format, keeping the first error so that every write doesn't need to be checked.
+type binWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (bw *binWriter) write(v interface{}) {
+	if bw.err == nil {
+		bw.err = binary.Write(bw.w, binary.LittleEndian, v)
+	}
+}
+
+func (bw *binWriter) str(s string) {
+	bw.write(uint32(len(s)))
+	if bw.err == nil {
+		_, bw.err = bw.w.WriteString(s)
+	}
+}
+
+func (bw *binWriter) header(kind uint8, count int) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(binaryMagic)
+	}
+	bw.write(binaryVersion)
+	bw.write(kind)
+	bw.write(uint32(count))
+}
+
+// Reads values in the flat binary format, keeping the first error.
+type binReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (br *binReader) read(v interface{}) {
+	if br.err == nil {
+		br.err = binary.Read(br.r, binary.LittleEndian, v)
+	}
+}
+
+func (br *binReader) str() string {
+	var n uint32
+	br.read(&n)
+	if br.err != nil {
+		return ""
+	}
+	if n > maxBinaryString {
+		br.err = errors.New("string too long in geobed binary file")
+		return ""
+	}
+	b := make([]byte, n)
+	_, br.err = io.ReadFull(br.r, b)
+	return string(b)
+}
+
+func (br *binReader) f64() float64 {
+	var bits uint64
+	br.read(&bits)
+	return math.Float64frombits(bits)
+}
+
+func (br *binReader) i32() int32 {
+	var v int32
+	br.read(&v)
+	return v
+}
+
+func (br *binReader) i16() int16 {
+	var v int16
+	br.read(&v)
+	return v
+}
+
+// Reads the header, making sure it's the expected kind of data, and returns the record count.
+func (br *binReader) header(kind uint8) (int, error) {
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(br.r, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != string(binaryMagic) {
+		return 0, errors.New("not a geobed binary file")
+	}
+	var version uint16
+	var k uint8
+	var count uint32
+	br.read(&version)
+	br.read(&k)
+	br.read(&count)
+	if br.err != nil {
+		return 0, br.err
+	}
+	if version != binaryVersion {
+		return 0, errors.New("unsupported geobed binary file version")
+	}
+	if k != kind {
+		return 0, errors.New("unexpected kind of geobed binary file")
+	}
+	return int(count), nil
+}
+
+// The field order of a city record.
+func (bw *binWriter) writeCity(c GeobedCity) {
+	bw.str(c.City)
+	bw.str(c.CityLower)
+	bw.str(c.CityAlt)
+	bw.str(c.Country)
+	bw.str(c.Region)
+	bw.write(math.Float64bits(c.Latitude))
+	bw.write(math.Float64bits(c.Longitude))
+	bw.write(c.Population)
+	bw.str(c.Geohash)
+	bw.str(c.FeatureCode)
+	bw.str(c.Timezone)
+	bw.write(c.Elevation)
+}
+
+func (br *binReader) readCity() GeobedCity {
+	var c GeobedCity
+	c.City = br.str()
+	c.CityLower = br.str()
+	c.CityAlt = br.str()
+	c.Country = br.str()
+	c.Region = br.str()
+	c.Latitude = br.f64()
+	c.Longitude = br.f64()
+	c.Population = br.i32()
+	c.Geohash = br.str()
+	c.FeatureCode = br.str()
+	c.Timezone = br.str()
+	c.Elevation = br.i32()
+	return c
+}
+
+// The field order of a country record.
+func (bw *binWriter) writeCountry(co CountryInfo) {
+	bw.str(co.Country)
+	bw.str(co.Capital)
+	bw.write(co.Area)
+	bw.write(co.Population)
+	bw.write(co.GeonameId)
+	bw.write(co.ISONumeric)
+	bw.str(co.ISO)
+	bw.str(co.ISO3)
+	bw.str(co.Fips)
+	bw.str(co.Continent)
+	bw.str(co.Tld)
+	bw.str(co.CurrencyCode)
+	bw.str(co.CurrencyName)
+	bw.str(co.Phone)
+	bw.str(co.PostalCodeFormat)
+	bw.str(co.PostalCodeRegex)
+	bw.str(co.Languages)
+	bw.str(co.Neighbours)
+	bw.str(co.EquivalentFipsCode)
+}
+
+func (br *binReader) readCountry() CountryInfo {
+	var co CountryInfo
+	co.Country = br.str()
+	co.Capital = br.str()
+	co.Area = br.i32()
+	co.Population = br.i32()
+	co.GeonameId = br.i32()
+	co.ISONumeric = br.i16()
+	co.ISO = br.str()
+	co.ISO3 = br.str()
+	co.Fips = br.str()
+	co.Continent = br.str()
+	co.Tld = br.str()
+	co.CurrencyCode = br.str()
+	co.CurrencyName = br.str()
+	co.Phone = br.str()
+	co.PostalCodeFormat = br.str()
+	co.PostalCodeRegex = br.str()
+	co.Languages = br.str()
+	co.Neighbours = br.str()
+	co.EquivalentFipsCode = br.str()
+	return co
+}
+
+// Don't trust a record count enough to allocate more than this up front (a corrupt file could claim billions).
+const maxBinaryPrealloc = 1 << 22
+
+// Nor a string length, no field is anywhere near this long.
+const maxBinaryString = 1 << 20
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Writes the cities to a file in the flat binary format.
+func storeCitiesBinary(path string, c []GeobedCity) error {
+	return writeBinaryFile(path, func(bw *binWriter) {
+		bw.header(binaryKindCities, len(c))
+		for _, v := range c {
+			bw.writeCity(v)
+		}
+	})
+}
+
+// Writes the countries to a file in the flat binary format.
+func storeCountriesBinary(path string, co []CountryInfo) error {
+	return writeBinaryFile(path, func(bw *binWriter) {
+		bw.header(binaryKindCountry, len(co))
+		for _, v := range co {
+			bw.writeCountry(v)
+		}
+	})
+}
+
+func writeBinaryFile(path string, write func(bw *binWriter)) error {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	bw := &binWriter{w: bufio.NewWriter(fh)}
+	write(bw)
+	if bw.err != nil {
+		return bw.err
+	}
+	return bw.w.Flush()
+}
+
+// Reads cities from a file in the flat binary format.
+func loadCitiesBinary(fsys fs.FS, name string) ([]GeobedCity, error) {
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	br := &binReader{r: bufio.NewReader(fh)}
+	count, err := br.header(binaryKindCities)
+	if err != nil {
+		return nil, err
+	}
+	gc := make([]GeobedCity, 0, minInt(count, maxBinaryPrealloc))
+	for i := 0; i < count && br.err == nil; i++ {
+		gc = append(gc, br.readCity())
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return gc, nil
+}
+
+// Reads countries from a file in the flat binary format.
+func loadCountriesBinary(fsys fs.FS, name string) ([]CountryInfo, error) {
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	br := &binReader{r: bufio.NewReader(fh)}
+	count, err := br.header(binaryKindCountry)
+	if err != nil {
+		return nil, err
+	}
+	co := make([]CountryInfo, 0, minInt(count, maxBinaryPrealloc))
+	for i := 0; i < count && br.err == nil; i++ {
+		co = append(co, br.readCountry())
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return co, nil
+}
@@ -0,0 +1,78 @@
+package geobed
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A least recently used cache of Geocode() results, so repeated queries (the same few big cities come up a lot) are map lookups.
+// A nil cache caches nothing.
+type resultCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[resultCacheKey]*list.Element
+}
+
+// Results depend on the options as well as the query.
+type resultCacheKey struct {
+	query   string
+	options GeocodeOptions
+}
+
+type resultCacheEntry struct {
+	key resultCacheKey
+	c   GeobedCity
+}
+
+// Returns a cache holding up to size results, or nil if size is less than 1.
+func newResultCache(size int) *resultCache {
+	if size < 1 {
+		return nil
+	}
+	return &resultCache{size: size, ll: list.New(), items: make(map[resultCacheKey]*list.Element)}
+}
+
+func (rc *resultCache) get(k resultCacheKey) (GeobedCity, bool) {
+	if rc == nil {
+		return GeobedCity{}, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.items[k]
+	if !ok {
+		return GeobedCity{}, false
+	}
+	rc.ll.MoveToFront(e)
+	return e.Value.(*resultCacheEntry).c, true
+}
+
+func (rc *resultCache) add(k resultCacheKey, c GeobedCity) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if e, ok := rc.items[k]; ok {
+		rc.ll.MoveToFront(e)
+		e.Value.(*resultCacheEntry).c = c
+		return
+	}
+	rc.items[k] = rc.ll.PushFront(&resultCacheEntry{key: k, c: c})
+	if rc.ll.Len() > rc.size {
+		oldest := rc.ll.Back()
+		rc.ll.Remove(oldest)
+		delete(rc.items, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// Empties the cache, for when the data changes.
+func (rc *resultCache) purge() {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.ll.Init()
+	rc.items = make(map[resultCacheKey]*list.Element)
+}
@@ -0,0 +1,144 @@
+package geobed
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules for cleaning up the city names in the data sets as they're loaded. MaxMind's data set in particular is a bit dirty.
+type CityNameRules struct {
+	// Characters trimmed off both ends of a name.
+	Trim string
+	// Names wrapped in parenthesis have them removed, ie. "(Dirty)" becomes "Dirty".
+	Unwrap bool
+	// Names containing any of these characters are erroneous and skipped.
+	Reject string
+	// Numbers at the end of a name are removed, ie. "Springfield 2". Names starting with a number are often real (ie. "23 de Enero") so those are left alone.
+	// Names that are only a number are skipped.
+	TrimDigits bool
+	// Stray dashes at either end of a name are removed, ie. "- Austin".
+	TrimDashes bool
+}
+
+// The rules used unless others are set with WithCityNameRules().
+var DefaultCityNameRules = CityNameRules{Trim: " ", Unwrap: true, Reject: "!@", TrimDigits: true, TrimDashes: true}
+
+// Cleans a city name from one of the data sets using the configured rules. The bool is false if the city should be skipped.
+func (cfg config) cleanCityName(name string) (string, bool) {
+	r := cfg.cityNames
+	name = strings.Trim(name, r.Trim)
+	for changed := true; changed; {
+		before := name
+		if r.Unwrap && strings.HasPrefix(name, "(") && strings.HasSuffix(name, ")") {
+			name = strings.TrimSpace(name[1 : len(name)-1])
+		}
+		if r.TrimDashes {
+			name = strings.TrimSpace(strings.Trim(name, "-–"))
+		}
+		if r.TrimDigits {
+			if i := strings.LastIndexByte(name, ' '); i != -1 && isDigits(name[i+1:]) {
+				name = strings.TrimSpace(name[:i])
+			}
+		}
+		name = strings.Trim(name, r.Trim)
+		changed = name != before
+	}
+	if name == "" || (r.Reject != "" && strings.ContainsAny(name, r.Reject)) || (r.TrimDigits && isDigits(name)) {
+		return name, false
+	}
+	return name, true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Cleans up a query before it's matched. Any kind of whitespace (ie. non-breaking spaces from copied and pasted text) becomes a plain
+// space and invisible characters like zero-width spaces and byte order marks are removed, then the ends are trimmed.
+func cleanQuery(n string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u200b' || r == '\u200c' || r == '\u200d' || r == '\u2060' || r == '\ufeff':
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, n))
+}
+
+// Splits a US state or country code off the end of a query that has no spaces or commas, ie. "AustinTX" (from a URL slug or a broken form)
+// becomes "Austin, TX". The code has to be uppercase after a lowercase letter so that names like "Dallas" or abbreviations like "USA" aren't split.
+func (g *GeoBed) unglued(n string) string {
+	if len(n) < 4 || strings.ContainsAny(n, " ,") {
+		return n
+	}
+	city, code := n[:len(n)-2], n[len(n)-2:]
+	if code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return n
+	}
+	if last, _ := utf8.DecodeLastRuneInString(city); !unicode.IsLower(last) {
+		return n
+	}
+	if _, ok := UsSateCodes[code]; ok {
+		return city + ", " + code
+	}
+	for _, co := range g.co {
+		if co.ISO == code {
+			return city + ", " + code
+		}
+	}
+	return n
+}
+
+// Filler phrases people put before their location (ie. "based out of Austin, TX") that are removed from queries. Use WithStopwords() to change them.
+var DefaultStopwords = []string{
+	"living in", "lives in", "live in", "based in", "based out of", "located in", "residing in", "currently in", "currently", "now in",
+	"i'm in", "i am in", "hailing from", "from",
+}
+
+// Removes stopwords from a query, longest phrase first. The query is returned unchanged if it's nothing but stopwords or is itself the name
+// of a city (ie. "From" isn't likely a place, but you never know).
+func (g *GeoBed) withoutStopwords(n string) string {
+	if len(g.cfg.stopwords) == 0 {
+		return n
+	}
+	words := strings.Fields(n)
+	kept := []string{}
+	for i := 0; i < len(words); {
+		skip := 0
+		for _, sw := range g.cfg.stopwords {
+			if l := len(sw); l > skip && l <= len(words)-i && phraseIs(words[i:i+l], sw) {
+				skip = l
+			}
+		}
+		if skip == 0 {
+			kept = append(kept, words[i])
+			skip = 1
+		}
+		i += skip
+	}
+	if len(kept) == len(words) || len(kept) == 0 || len(g.citiesByName(n)) > 0 {
+		return n
+	}
+	return strings.Trim(strings.Join(kept, " "), " ,")
+}
+
+// Whether the words are the phrase (lowercase words), ignoring case and punctuation around them.
+func phraseIs(words []string, phrase []string) bool {
+	for i, w := range words {
+		if toLower(strings.Trim(w, ",.:")) != phrase[i] {
+			return false
+		}
+	}
+	return true
+}
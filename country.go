@@ -0,0 +1,537 @@
+package geobed
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The extent of a country's cities. When the country crosses the antimeridian (ie. Fiji), minLng is greater than maxLng.
+type countryBounds struct {
+	minLat float64
+	minLng float64
+	maxLat float64
+	maxLng float64
+}
+
+// Whether a point is within the bounds.
+func (b countryBounds) contains(lat float64, lng float64) bool {
+	if lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	if b.minLng > b.maxLng {
+		return lng >= b.minLng || lng <= b.maxLng
+	}
+	return lng >= b.minLng && lng <= b.maxLng
+}
+
+// The size of the bounds in square degrees. Only good for comparing bounds with each other.
+func (b countryBounds) area() float64 {
+	w := b.maxLng - b.minLng
+	if w < 0 {
+		w += 360
+	}
+	return w * (b.maxLat - b.minLat)
+}
+
+// Other names countries commonly go by (Geonames only has one), keyed by lowercase name.
+var countryAltNames = map[string]string{
+	"côte d'ivoire":       "CI",
+	"cote d'ivoire":       "CI",
+	"timor-leste":         "TL",
+	"east timor":          "TL",
+	"st. kitts and nevis": "KN",
+	"st kitts and nevis":  "KN",
+}
+
+// A regular expression finding a country's name in a location string.
+type countryPattern struct {
+	re  *regexp.Regexp
+	iso string
+}
+
+// Spaces and hyphens in country names are interchangeable (ie. "Timor Leste" and "Timor-Leste"), while periods and apostrophes can be left out.
+var countryNameReplacer = strings.NewReplacer(" ", `[\s-]+`, "-", `[\s-]+`, `\.`, `\.?`, "'", `['’]?`)
+
+// Builds the pattern for a country name, which must be a whole word (or words) in the location string.
+func newCountryPattern(name string, iso string) countryPattern {
+	p := countryNameReplacer.Replace(regexp.QuoteMeta(name))
+	return countryPattern{re: regexp.MustCompile(`(?i)(^|\s)` + p + `(,|\s|$)`), iso: iso}
+}
+
+// Builds the country name patterns used when geocoding.
+func (g *GeoBed) indexCountryNames() {
+	names := map[string]string{}
+	for _, co := range g.co {
+		if co.Country != "" {
+			names[co.Country] = co.ISO
+		}
+	}
+	for name, iso := range countryAltNames {
+		names[name] = iso
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	g.countryPatterns = make([]countryPattern, 0, len(sorted))
+	for _, name := range sorted {
+		g.countryPatterns = append(g.countryPatterns, newCountryPattern(name, names[name]))
+	}
+}
+
+// Works out the bounds of each country from its cities as well as where each capital and each region's largest city is.
+func (g *GeoBed) indexCountries() {
+	capitals := map[string]string{}
+	for _, co := range g.co {
+		if co.Capital != "" {
+			capitals[co.ISO] = foldLower(co.Capital)
+		}
+	}
+
+	type extent struct {
+		countryBounds
+		// Longitudes shifted to 0 to 360 so that a country crossing the antimeridian has a small extent in one of the two.
+		minLng360, maxLng360 float64
+	}
+	extents := map[string]*extent{}
+	capitalPop := map[string]int32{}
+	g.countryCapitalIdx = make(map[string]int)
+	g.regionLargestIdx = make(map[string]int)
+	for k, v := range g.c {
+		if v.Country == "" || (v.Latitude == 0 && v.Longitude == 0) {
+			continue
+		}
+		lng360 := v.Longitude
+		if lng360 < 0 {
+			lng360 += 360
+		}
+		e, ok := extents[v.Country]
+		if !ok {
+			extents[v.Country] = &extent{countryBounds{v.Latitude, v.Longitude, v.Latitude, v.Longitude}, lng360, lng360}
+		} else {
+			e.minLat = math.Min(e.minLat, v.Latitude)
+			e.maxLat = math.Max(e.maxLat, v.Latitude)
+			e.minLng = math.Min(e.minLng, v.Longitude)
+			e.maxLng = math.Max(e.maxLng, v.Longitude)
+			e.minLng360 = math.Min(e.minLng360, lng360)
+			e.maxLng360 = math.Max(e.maxLng360, lng360)
+		}
+
+		// There can be more than one city with the capital's name in a country, the largest one is most likely it.
+		if capital, ok := capitals[v.Country]; ok && v.CityLower == capital {
+			if p, seen := capitalPop[v.Country]; !seen || v.Population > p {
+				capitalPop[v.Country] = v.Population
+				g.countryCapitalIdx[v.Country] = k
+			}
+		}
+
+		if v.Region != "" {
+			rk := v.Country + "." + v.Region
+			if lk, ok := g.regionLargestIdx[rk]; !ok || v.Population > g.c[lk].Population {
+				g.regionLargestIdx[rk] = k
+			}
+		}
+	}
+
+	g.indexCountryNames()
+	g.indexCountryCodes()
+
+	g.countryBoundsIdx = make(map[string]countryBounds, len(extents))
+	for iso, e := range extents {
+		b := e.countryBounds
+		if e.maxLng360-e.minLng360 < e.maxLng-e.minLng {
+			b.minLng = e.minLng360
+			b.maxLng = e.maxLng360
+			if b.minLng > 180 {
+				b.minLng -= 360
+			}
+			if b.maxLng > 180 {
+				b.maxLng -= 360
+			}
+		}
+		g.countryBoundsIdx[iso] = b
+	}
+}
+
+// Returns the extent of a country's cities (a rough bounding box for the country). If the country crosses the antimeridian, minLng is greater than maxLng.
+// The last value is false if there are no cities for the country.
+func (g *GeoBed) CountryBounds(iso string) (minLat float64, minLng float64, maxLat float64, maxLng float64, ok bool) {
+	defer g.rlock()()
+	b, ok := g.countryBoundsIdx[toUpper(iso)]
+	return b.minLat, b.minLng, b.maxLat, b.maxLng, ok
+}
+
+// Returns the country a coordinate most likely belongs to. This is the country of the city ReverseGeocode() finds. When no city is found
+// (ie. in the ocean or a desert), the country whose bounds contain the point is used (the smallest if there are several) and failing that,
+// the country with the closest capital. The second value is false if no country could be found at all.
+func (g *GeoBed) ReverseGeocodeCountry(lat float64, lng float64) (CountryInfo, bool) {
+	defer g.rlock()()
+	return g.reverseGeocodeCountry(lat, lng)
+}
+
+func (g *GeoBed) reverseGeocodeCountry(lat float64, lng float64) (CountryInfo, bool) {
+	if c, _ := g.reverseGeocode(context.Background(), lat, lng, nil); c.Country != "" {
+		if co, ok := g.countryInfo(c.Country); ok {
+			return co, true
+		}
+	}
+
+	iso := ""
+	smallest := 0.0
+	for k, b := range g.countryBoundsIdx {
+		if b.contains(lat, lng) && (iso == "" || b.area() < smallest || (b.area() == smallest && k < iso)) {
+			iso = k
+			smallest = b.area()
+		}
+	}
+	if iso == "" {
+		closest := 0.0
+		for k, ck := range g.countryCapitalIdx {
+			d := Distance(lat, lng, g.c[ck].Latitude, g.c[ck].Longitude)
+			if iso == "" || d < closest || (d == closest && k < iso) {
+				iso = k
+				closest = d
+			}
+		}
+	}
+	return g.countryInfo(iso)
+}
+
+// Returns the neighbor (see CountryInfo.Neighbours) of the country a coordinate is in (see ReverseGeocodeCountry()) that's closest to it,
+// going by the distance to the neighbor's nearest city. Useful near borders, ie. for roaming or shipping. The second value is false if the
+// country has no neighbors with any cities.
+func (g *GeoBed) NearestNeighbourCountry(lat float64, lng float64) (CountryInfo, bool) {
+	if checkCoordinate(lat, lng) != nil {
+		return CountryInfo{}, false
+	}
+	defer g.rlock()()
+	co, ok := g.reverseGeocodeCountry(lat, lng)
+	if !ok {
+		return CountryInfo{}, false
+	}
+	neighbours := map[string]bool{}
+	for _, iso := range strings.Split(co.Neighbours, ",") {
+		// Neighbours without any cities have no bounds and can't be measured.
+		if _, ok := g.countryBoundsIdx[iso]; ok {
+			neighbours[iso] = true
+		}
+	}
+	if len(neighbours) == 0 {
+		return CountryInfo{}, false
+	}
+
+	iso := ""
+	closest := 0.0
+	for _, v := range g.c {
+		if !neighbours[v.Country] {
+			continue
+		}
+		if d := Distance(lat, lng, v.Latitude, v.Longitude); iso == "" || d < closest {
+			iso = v.Country
+			closest = d
+		}
+	}
+	return g.countryInfo(iso)
+}
+
+// Returns the city closest to the geographic center of a country's cities, for placing a label or pin for the whole country. For large
+// countries this is more central than the capital. The second value is false if there are no cities for the country.
+func (g *GeoBed) CentralCity(iso string) (GeobedCity, bool) {
+	defer g.rlock()()
+	iso = toUpper(iso)
+	var lats, lngs []float64
+	for _, v := range g.c {
+		if v.Country == iso && (v.Latitude != 0 || v.Longitude != 0) {
+			lats = append(lats, v.Latitude)
+			lngs = append(lngs, v.Longitude)
+		}
+	}
+	lat, lng, ok := centroid(lats, lngs)
+	if !ok {
+		return GeobedCity{}, false
+	}
+
+	ck := -1
+	closest := 0.0
+	for k, v := range g.c {
+		if v.Country != iso || (v.Latitude == 0 && v.Longitude == 0) {
+			continue
+		}
+		if d := Distance(lat, lng, v.Latitude, v.Longitude); ck == -1 || d < closest {
+			ck = k
+			closest = d
+		}
+	}
+	return g.c[ck], true
+}
+
+// Returns the cities on the convex hull of a country's cities, in counterclockwise order, for drawing a rough outline of the country when
+// there's no boundary data. It's only as good as the cities are spread out, so coastlines and borders without towns get cut off. Countries
+// that cross the antimeridian (ie. Fiji) are handled. Empty if there are no cities for the country.
+func (g *GeoBed) CountryHull(iso string) []GeobedCity {
+	defer g.rlock()()
+	iso = toUpper(iso)
+	hull := []GeobedCity{}
+	b, ok := g.countryBoundsIdx[iso]
+	if !ok {
+		return hull
+	}
+	// Across the antimeridian the longitudes to the west of it continue on past 180 instead of wrapping.
+	wraps := b.minLng > b.maxLng
+	x := func(c GeobedCity) float64 {
+		if wraps && c.Longitude < 0 {
+			return c.Longitude + 360
+		}
+		return c.Longitude
+	}
+
+	pts := []GeobedCity{}
+	seen := map[[2]float64]bool{}
+	for _, v := range g.c {
+		if v.Country != iso || (v.Latitude == 0 && v.Longitude == 0) {
+			continue
+		}
+		p := [2]float64{v.Longitude, v.Latitude}
+		if !seen[p] {
+			seen[p] = true
+			pts = append(pts, v)
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool {
+		if x(pts[i]) != x(pts[j]) {
+			return x(pts[i]) < x(pts[j])
+		}
+		return pts[i].Latitude < pts[j].Latitude
+	})
+	if len(pts) < 3 {
+		return append(hull, pts...)
+	}
+
+	// Andrew's monotone chain, the lower half and then the upper half.
+	cross := func(o, a, b GeobedCity) float64 {
+		return (x(a)-x(o))*(b.Latitude-o.Latitude) - (a.Latitude-o.Latitude)*(x(b)-x(o))
+	}
+	for _, p := range pts {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(pts) - 2; i >= 0; i-- {
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], pts[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, pts[i])
+	}
+	// The last point is the first one again.
+	return hull[:len(hull)-1]
+}
+
+// Returns the cities with at least minPop people in the countries using a currency (ie. "EUR"), largest population first.
+func (g *GeoBed) CitiesByCurrency(code string, minPop int32) []GeobedCity {
+	defer g.rlock()()
+	countries := map[string]bool{}
+	for _, co := range g.co {
+		if strings.EqualFold(co.CurrencyCode, code) && code != "" {
+			countries[co.ISO] = true
+		}
+	}
+	cities := []GeobedCity{}
+	if len(countries) == 0 {
+		return cities
+	}
+	for _, v := range g.c {
+		if countries[v.Country] && v.Population >= minPop {
+			cities = append(cities, v)
+		}
+	}
+	return largestCities(cities, 0)
+}
+
+// Continent names by the codes used in CountryInfo.Continent.
+var continentNames = map[string]string{
+	"AF": "Africa",
+	"AN": "Antarctica",
+	"AS": "Asia",
+	"EU": "Europe",
+	"NA": "North America",
+	"OC": "Oceania",
+	"SA": "South America",
+}
+
+// Returns the full name of a region (ie. "Ontario" for "CA" and "08"), from the Geonames admin1 codes. MaxMind region codes that differ
+// from the Geonames ones are looked up through RegionCrosswalk. A region that isn't known is returned as the code it was given.
+func (g *GeoBed) RegionName(countryISO string, regionCode string) string {
+	defer g.rlock()()
+	return g.regionName(countryISO, regionCode)
+}
+
+func (g *GeoBed) regionName(countryISO string, regionCode string) string {
+	country := toUpper(strings.TrimSpace(countryISO))
+	region := canonicalRegion(regionCode)
+	if name, ok := g.regionNames[country+"."+region]; ok {
+		return name
+	}
+	if name, ok := g.regionNames[country+"."+GeonamesRegion(country, region)]; ok {
+		return name
+	}
+	// Without the admin1 codes data set, at least the US states have names.
+	if country == "US" {
+		if name, ok := UsSateCodes[usStateCode(region)]; ok {
+			return name
+		}
+	}
+	return regionCode
+}
+
+// Returns the names of the region, country and continent a city is in, ie. "Texas", "United States" and "North America" for Austin.
+// Regions that aren't known (see RegionName()) are returned as their codes. Countries and continents that aren't known are empty.
+func (g *GeoBed) Hierarchy(c GeobedCity) (region string, country string, continent string) {
+	defer g.rlock()()
+	region = g.regionName(c.Country, c.Region)
+	if co, ok := g.countryInfo(c.Country); ok {
+		country = co.Country
+		continent = continentNames[co.Continent]
+	}
+	return region, country, continent
+}
+
+// Returns a country by its two or three letter ISO code (ie. "FR" or "FRA"), case insensitive. Handy for the full details of a city's
+// country (capital, currency, phone code, etc.). The second value is false if there's no such country.
+func (g *GeoBed) CountryByISO(code string) (CountryInfo, bool) {
+	defer g.rlock()()
+	return g.countryInfo(toUpper(strings.TrimSpace(code)))
+}
+
+// Returns a country by its name (ie. "France"), case insensitive and with or without diacritics. A few other common names are also known
+// (ie. "East Timor"). The second value is false if there's no such country.
+func (g *GeoBed) CountryByName(name string) (CountryInfo, bool) {
+	defer g.rlock()()
+	name = strings.TrimSpace(name)
+	if k, ok := g.countryNameIdx[foldLower(name)]; ok {
+		return g.co[k], true
+	}
+	return g.countryInfo(countryAltNames[toLower(name)])
+}
+
+// Looks up a country by its (uppercase) ISO code.
+func (g *GeoBed) countryInfo(iso string) (CountryInfo, bool) {
+	if k, ok := g.countryIdx[iso]; ok {
+		return g.co[k], true
+	}
+	return CountryInfo{}, false
+}
+
+// Indexes the countries by ISO code and name.
+func (g *GeoBed) indexCountryCodes() {
+	g.countryIdx = make(map[string]int, 2*len(g.co))
+	g.countryNameIdx = make(map[string]int, len(g.co))
+	for k, co := range g.co {
+		for _, code := range []string{co.ISO, co.ISO3} {
+			if code != "" {
+				g.countryIdx[code] = k
+			}
+		}
+		if co.Country != "" {
+			g.countryNameIdx[foldLower(co.Country)] = k
+		}
+	}
+}
+
+// When a whole query is the name of a country (ie. "France") or a US state (ie. "Texas"), returns the country's capital or the state's largest city.
+// Countries are checked first. The second value is false when the query isn't a country or state.
+func (g *GeoBed) regionOrCountryMatch(n string) (GeobedCity, bool) {
+	q := strings.Trim(n, " ,.")
+	k := -1
+	level := MatchCity
+	iso, named := countryAltNames[toLower(q)]
+	if !named {
+		for _, co := range g.co {
+			if strings.EqualFold(q, co.Country) {
+				iso, named = co.ISO, true
+				break
+			}
+		}
+	}
+	if ck, ok := g.countryCapitalIdx[iso]; named && ok {
+		k = ck
+		level = MatchCountry
+	}
+	if k == -1 {
+		for sc, name := range UsSateCodes {
+			if strings.EqualFold(q, name) {
+				if rk, ok := g.regionLargestIdx["US."+sc]; ok {
+					k = rk
+					level = MatchRegion
+				}
+				break
+			}
+		}
+	}
+	if k == -1 {
+		return GeobedCity{}, false
+	}
+
+	// A city with the same name (or alternate name) that's big in its own right is more likely what's meant (ie. "New York" or "Singapore").
+	for _, c := range g.citiesByName(q) {
+		if c.Population >= 100000 {
+			return GeobedCity{}, false
+		}
+	}
+	for _, ak := range g.altNameIdx[toLower(q)] {
+		if g.c[ak].Population >= 100000 {
+			return GeobedCity{}, false
+		}
+	}
+
+	c := g.c[k]
+	c.MatchLevel = level
+	return c, true
+}
+
+// Loads only the country data, without any of the cities, for apps that just want country details (ie. currency or calling codes).
+// The cached dump in the data directory is used if it's current, otherwise the Geonames country info file is read. Nothing is downloaded.
+// An empty dataDir means the same directory NewGeobed() uses by default ($GEOBED_DATA_DIR or "./geobed-data").
+func LoadCountriesOnly(dataDir string) ([]CountryInfo, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir()
+	}
+	cache := os.DirFS(dataDir)
+	if meta, err := loadGeobedCacheMeta(cache); err == nil && meta.Version == cacheVersion {
+		if co, err := loadGeobedCountryData(cache, meta.Format); err == nil && len(co) > 0 {
+			return co, nil
+		}
+	}
+
+	for _, f := range dataSetFiles {
+		if f["id"] != "geonamesCountryInfo" {
+			continue
+		}
+		fi, err := openDataFile(filepath.Join(dataDir, filepath.Base(f["path"])))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, wrapErr(ErrDataNotFound, err)
+			}
+			return nil, err
+		}
+		defer fi.Close()
+
+		g := GeoBed{}
+		g.loadGeonamesCountryInfo(fi)
+		return g.co, nil
+	}
+	return nil, wrapErr(ErrDataNotFound, errors.New("no country data set"))
+}
@@ -0,0 +1,167 @@
+package geobed
+
+import (
+	"math"
+	"sort"
+)
+
+// The mean radius of the Earth in kilometers.
+const earthRadiusKm = 6371.0
+
+// Returns the great-circle distance in kilometers between two points using the haversine formula.
+func Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func toRadians(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func toDegrees(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// Returns the initial bearing in degrees (0 is north, 90 is east) to head in from the first point to get to the second along a great circle.
+func bearing(lat1, lng1, lat2, lng2 float64) float64 {
+	la1, la2 := toRadians(lat1), toRadians(lat2)
+	dLng := toRadians(lng2 - lng1)
+	y := math.Sin(dLng) * math.Cos(la2)
+	x := math.Cos(la1)*math.Sin(la2) - math.Sin(la1)*math.Cos(la2)*math.Cos(dLng)
+	return math.Mod(toDegrees(math.Atan2(y, x))+360, 360)
+}
+
+// Returns the cities within maxKm of a point in a direction, nearest first. ie. bearingDeg 0 and toleranceDeg 45 gives the cities to the
+// north, from northwest to northeast. Cities right at the point have no direction and are left out.
+func (g *GeoBed) CitiesInDirection(lat float64, lng float64, bearingDeg float64, toleranceDeg float64, maxKm float64) []GeobedCity {
+	cities := []GeobedCity{}
+	if checkCoordinate(lat, lng) != nil {
+		return cities
+	}
+	defer g.rlock()()
+	dists := map[int]float64{}
+	keys := []int{}
+	for _, k := range g.keysWithin(lat, lng, maxKm) {
+		v := g.c[k]
+		d := Distance(lat, lng, v.Latitude, v.Longitude)
+		if d == 0 {
+			continue
+		}
+		// How far off the bearing the city is, either way around.
+		off := math.Abs(math.Mod(bearing(lat, lng, v.Latitude, v.Longitude)-bearingDeg+540, 360) - 180)
+		if off <= toleranceDeg {
+			dists[k] = d
+			keys = append(keys, k)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return dists[keys[i]] < dists[keys[j]]
+	})
+	for _, k := range keys {
+		cities = append(cities, g.c[k])
+	}
+	return cities
+}
+
+// How far ReverseGeocodeN() looks for cities, about as far as ReverseGeocode() does.
+const nearbyMaxKm = 1000.0
+
+// Returns the n nearest cities to a lat/lng, nearest first by their actual distance, so a city just over a geohash cell boundary
+// still ranks by how close it is. Only cities within nearbyMaxKm are considered, so there can be fewer than n (or none, far out at sea).
+// Like ReverseGeocode(), this needs FieldGeohash to be loaded.
+func (g *GeoBed) ReverseGeocodeN(lat float64, lng float64, n int) []GeobedCity {
+	if n < 1 || checkCoordinate(lat, lng) != nil || (lat == 0 && lng == 0) {
+		return []GeobedCity{}
+	}
+	defer g.rlock()()
+	// Widen the search until it has enough cities, the n nearest of those are then the n nearest of all.
+	var keys []int
+	for r := 25.0; ; r *= 2 {
+		r = math.Min(r, nearbyMaxKm)
+		keys = g.keysWithin(lat, lng, r)
+		if len(keys) >= n || r == nearbyMaxKm {
+			break
+		}
+	}
+	cities := g.nearestFirst(lat, lng, keys)
+	if len(cities) > n {
+		cities = cities[:n]
+	}
+	return cities
+}
+
+// Returns all of the cities within radiusKm of a lat/lng, nearest first. ie. the towns within 50km of a store. Candidates come from the
+// geohash cells covering the circle and are then checked by their distance, so it works across the antimeridian and near the poles where
+// a box of degrees doesn't. Cities without a geohash (see WithLoadFields()) aren't found.
+// A limit above 0 returns only that many of the most populous cities instead, largest first (ie. the biggest towns to label on a map).
+func (g *GeoBed) CitiesWithinRadius(lat float64, lng float64, radiusKm float64, limit int) []GeobedCity {
+	if checkCoordinate(lat, lng) != nil {
+		return []GeobedCity{}
+	}
+	defer g.rlock()()
+	cities := g.nearestFirst(lat, lng, g.keysWithin(lat, lng, radiusKm))
+	if limit > 0 {
+		// Cities with the same population stay nearest first.
+		cities = largestCities(cities, limit)
+	}
+	return cities
+}
+
+// Returns the cities with the given keys, nearest to the point first. Cities the same distance away are in key order.
+func (g *GeoBed) nearestFirst(lat float64, lng float64, keys []int) []GeobedCity {
+	dists := make(map[int]float64, len(keys))
+	for _, k := range keys {
+		dists[k] = Distance(lat, lng, g.c[k].Latitude, g.c[k].Longitude)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if dists[keys[i]] != dists[keys[j]] {
+			return dists[keys[i]] < dists[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	cities := make([]GeobedCity, len(keys))
+	for i, k := range keys {
+		cities[i] = g.c[k]
+	}
+	return cities
+}
+
+// Returns the center of a set of points on the sphere, averaging them as 3D vectors so points on both sides of the antimeridian work.
+// ok is false if there are no points or they cancel each other out (ie. two opposite sides of the Earth).
+func centroid(lats []float64, lngs []float64) (lat float64, lng float64, ok bool) {
+	var x, y, z float64
+	for i := range lats {
+		la, ln := toRadians(lats[i]), toRadians(lngs[i])
+		x += math.Cos(la) * math.Cos(ln)
+		y += math.Cos(la) * math.Sin(ln)
+		z += math.Sin(la)
+	}
+	h := math.Sqrt(x*x + y*y)
+	if len(lats) == 0 || (h < 1e-9 && math.Abs(z) < 1e-9) {
+		return 0, 0, false
+	}
+	return toDegrees(math.Atan2(z, h)), toDegrees(math.Atan2(y, x)), true
+}
+
+// Geocodes a location string and also returns how far (in kilometers) the matched city is from a reference point, ie. "how far is this from our depot?"
+// The distance is -1 if no city was matched.
+func (g *GeoBed) GeocodeWithDistance(n string, refLat, refLng float64, opts ...GeocodeOptions) (GeobedCity, float64) {
+	c := g.Geocode(n, opts...)
+	if c.City == "" {
+		return c, -1
+	}
+	return c, Distance(refLat, refLng, c.Latitude, c.Longitude)
+}
+
+// Reverse geocodes a lat/lng and also returns how far (in kilometers) it is from the center of the city found, so matches that are
+// suspiciously far away (ie. a point out at sea) can be rejected. The distance is -1 if no city was found.
+func (g *GeoBed) ReverseGeocodeWithDistance(lat float64, lng float64) (GeobedCity, float64) {
+	c := g.ReverseGeocode(lat, lng)
+	if c.City == "" {
+		return c, -1
+	}
+	return c, Distance(lat, lng, c.Latitude, c.Longitude)
+}
@@ -0,0 +1,74 @@
+package geobed
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+)
+
+// The kinds of errors returned by this package. Use errors.Is() to check for them, ie. errors.Is(err, ErrDownloadFailed).
+var (
+	// A data set or cache file doesn't exist.
+	ErrDataNotFound = errors.New("geobed: data not found")
+	// A data set couldn't be downloaded.
+	ErrDownloadFailed = errors.New("geobed: download failed")
+	// A cache file couldn't be read, it's damaged or from an incompatible version.
+	ErrCacheCorrupt = errors.New("geobed: cache corrupt")
+	// A latitude or longitude is out of range (or not a number).
+	ErrInvalidCoordinate = errors.New("geobed: invalid coordinate")
+	// The loaded data is broken (see Validate()), or a data set file can't be read (ie. a damaged download).
+	ErrInvalidData = errors.New("geobed: invalid data")
+	// There's no data to use, the data sets (or cache) had no cities or countries in them.
+	ErrEmptyData = errors.New("geobed: empty data")
+)
+
+// An error of one of the kinds above, wrapping the underlying cause. errors.Is() matches both the kind and the cause.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Wraps an error as the given kind. A nil error stays nil.
+func wrapErr(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Wraps an error from reading a cache file, which is either missing or can't be read.
+func cacheErr(err error) error {
+	if os.IsNotExist(err) {
+		return wrapErr(ErrDataNotFound, err)
+	}
+	return wrapErr(ErrCacheCorrupt, err)
+}
+
+// Wraps an error from reading a data set file, which is either missing or damaged.
+func dataSetErr(err error) error {
+	if os.IsNotExist(err) {
+		return wrapErr(ErrDataNotFound, err)
+	}
+	return wrapErr(ErrInvalidData, err)
+}
+
+// Returns an ErrInvalidCoordinate error if the lat/lng isn't a valid coordinate.
+func checkCoordinate(lat float64, lng float64) error {
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return wrapErr(ErrInvalidCoordinate, errors.New(strconv.FormatFloat(lat, 'f', -1, 64)+", "+strconv.FormatFloat(lng, 'f', -1, 64)))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package geobed
+
+// Returns the Levenshtein distance between two strings (the fewest single character insertions, deletions and substitutions that turn
+// one into the other), counting runes rather than bytes. Anything over max is returned as max+1, which lets it give up early.
+func levenshtein(a string, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		// The distance can only grow from here.
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(rb)] > max {
+		return max + 1
+	}
+	return prev[len(rb)]
+}
+
+// Scores the cities in the search ranges whose names are within the distance set by WithFuzzyMatch() of the city asked for or one of the
+// words in the query, for when no city has the name asked for (ie. "Pheonix"). The closer the name, the higher the score, though never as
+// high as the name itself would have scored. Misspelled names are only found if the first letter is right, since that's how the search
+// ranges are chosen.
+func (g *GeoBed) scoreMisspelled(scores map[int]int, ranges []r, country string, names []string) {
+	max := g.cfg.fuzzyDistance
+	for _, rng := range ranges {
+		for i, v := range g.c[rng.f:rng.t] {
+			if country != "" && country != v.Country {
+				continue
+			}
+			d := max + 1
+			for _, name := range names {
+				if name != "" {
+					d = minInt(d, levenshtein(v.CityLower, name, max))
+				}
+			}
+			if d <= max {
+				scores[rng.f+i] += fuzzyMatchPoints - d
+			}
+		}
+	}
+}
+
+// A misspelled name scores this less its distance, so one edit away is a point less than the name itself.
+const fuzzyMatchPoints = 7
+
+// Whether any of the scored cities has a name (or alternate name) that's in the query as is, in which case there's no need to look for
+// misspellings.
+func (g *GeoBed) anyNamed(s map[int]int, aliases map[int]string, names []string) bool {
+	for k := range s {
+		if _, ok := aliases[k]; ok {
+			return true
+		}
+		for _, name := range names {
+			if name != "" && g.c[k].CityLower == name {
+				return true
+			}
+		}
+	}
+	return false
+}
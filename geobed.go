@@ -5,16 +5,26 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/gob"
+	"errors"
 	geohash "github.com/TomiHiltunen/geohash-golang"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // There are over 2.4 million cities in the world. The Geonames data set only contains 143,270 and the MaxMind set contains 567,382 and 3,173,959 in the other MaxMind set.
@@ -35,9 +45,13 @@ var dataSetFiles = []map[string]string{
 	{"url": "http://download.geonames.org/export/dump/cities1000.zip", "path": "./geobed-data/cities1000.zip", "id": "geonamesCities1000"},
 	{"url": "http://download.geonames.org/export/dump/countryInfo.txt", "path": "./geobed-data/countryInfo.txt", "id": "geonamesCountryInfo"},
 	{"url": "http://download.maxmind.com/download/worldcities/worldcitiespop.txt.gz", "path": "./geobed-data/worldcitiespop.txt.gz", "id": "maxmindWorldCities"},
+	{"url": "http://download.geonames.org/export/dump/admin1CodesASCII.txt", "path": "./geobed-data/admin1CodesASCII.txt", "id": "geonamesAdmin1Codes"},
 	//{"url": "http://geolite.maxmind.com/download/geoip/database/GeoLiteCity_CSV/GeoLiteCity-latest.zip", "path": "./geobed-data/GeoLiteCity-latest.zip", "id": "maxmindLiteCity"},
 }
 
+// The files written by store() to cache the loaded data sets.
+var cacheFiles = []string{"g.c.dmp", "g.co.dmp", "g.c.bin", "g.co.bin", "cityNameIdx.dmp", "regionNames.dmp", "spatialIdx.dmp", "meta.dmp"}
+
 // A handy map of US state codes to full names.
 var UsSateCodes = map[string]string{
 	"AL": "Alabama",
@@ -107,9 +121,63 @@ var UsSateCodes = map[string]string{
 }
 
 // Contains all of the city and country data. Cities are split into buckets by country to increase lookup speed when the country is known.
+// It's safe to use from several goroutines at once, including while Update() reloads the data. Share a pointer to it rather than copies,
+// a reload only replaces the data of the GeoBed it's called on.
 type GeoBed struct {
-	c  Cities
-	co []CountryInfo
+	c   Cities
+	co  []CountryInfo
+	cfg config
+	// Held for reading by lookups and for writing while the data is swapped out by a reload. A pointer so copies of the GeoBed share it.
+	mu *sync.RWMutex
+	// Held by Update() and ReloadDataSets() from the first download until the cache is written, so two reloads can't overwrite each
+	// other's files or store one's data with the other's cache.
+	reloadMu *sync.Mutex
+	// Holds information about the index ranges for city names (1st and 2nd characters) to help narrow down sets of the GeobedCity slice to scan when looking for a match.
+	cityNameIdx map[string]int
+	// Maps lowercase alternate city names to the keys of the cities that have them. Alternate names can be anything (ie. "Big Apple" for New York City),
+	// so they can't be found by searching the ranges of city names.
+	altNameIdx map[string][]int
+	// Country bounds and capital cities (keys in the city data) keyed by ISO country code. Built from the city data by indexCountries().
+	countryBoundsIdx  map[string]countryBounds
+	countryCapitalIdx map[string]int
+	// The key of the largest city in each region, keyed by country and region (ie. "US.TX").
+	regionLargestIdx map[string]int
+	// Region names from the Geonames admin1 codes, keyed the same way, see RegionName().
+	regionNames map[string]string
+	// Keys in the country data by ISO code (both the two and three letter ones) and by folded name, see CountryByISO() and CountryByName().
+	countryIdx     map[string]int
+	countryNameIdx map[string]int
+	// The patterns for all country names, longest name first so "Guinea-Bissau" is found before "Guinea". Built by indexCountries().
+	countryPatterns []countryPattern
+	// Only used while the data sets are loaded.
+	maxMindCityDedupeIdx map[string][]string
+	locationDedupeIdx    map[string]bool
+	// Built lazily, see WarmSpatialIndex()
+	spatial *spatialIndex
+	// The newest modification date in the Geonames data.
+	sourceDate time.Time
+	// Geocode() results, see WithCacheSize()
+	results *resultCache
+}
+
+// Locks the data for reading, so a reload (see Update()) can't swap it out partway through a lookup, and returns the function that unlocks
+// it. A lookup holding it mustn't call another one that takes it (a waiting reload would block them both). A GeoBed that wasn't made by
+// NewGeobed() has no lock.
+func (g *GeoBed) rlock() func() {
+	if g.mu == nil {
+		return func() {}
+	}
+	g.mu.RLock()
+	return g.mu.RUnlock
+}
+
+// Takes the reload lock (see Update()) and returns the function that releases it. A GeoBed that wasn't made by NewGeobed() has no lock.
+func (g *GeoBed) reloadLock() func() {
+	if g.reloadMu == nil {
+		return func() {}
+	}
+	g.reloadMu.Lock()
+	return g.reloadMu.Unlock
 }
 
 type Cities []GeobedCity
@@ -121,21 +189,75 @@ func (c Cities) Swap(i, j int) {
 	c[i], c[j] = c[j], c[i]
 }
 func (c Cities) Less(i, j int) bool {
-	return toLower(c[i].City) < toLower(c[j].City)
+	return c[i].CityLower < c[j].CityLower
 }
 
 // A combined city struct (the various data sets have different fields, this combines what's available and keeps things smaller).
 type GeobedCity struct {
-	City    string
-	CityAlt string
+	City string `json:"city"`
+	// The lowercase, plain ASCII form of the city name (ie. "sao paulo" for "São Paulo"). Used for matching and sorting while City is for display.
+	CityLower string `json:"city_lower"`
+	CityAlt   string `json:"city_alt,omitempty"`
 	// TODO: Think about converting this to a small int to save on memory allocation. Lookup requests can have the strings converted to the same int if there are any matches.
 	// This could make lookup more accurate, easier, and faster even. IF the int uses less bytes than the two letter code string.
-	Country    string
-	Region     string
-	Latitude   float64
-	Longitude  float64
-	Population int32
-	Geohash    string
+	Country    string  `json:"country"`
+	Region     string  `json:"region"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Population int32   `json:"population"`
+	Geohash    string  `json:"geohash,omitempty"`
+	// The Geonames feature code (ie. "PPLC" for a capital or "PPLA" for the seat of a first-level administrative division). Empty for MaxMind cities.
+	FeatureCode string `json:"feature_code,omitempty"`
+	// The IANA time zone (ie. "America/Chicago"), for use with time.LoadLocation(). Empty for MaxMind cities.
+	Timezone string `json:"timezone,omitempty"`
+	// In meters. Where Geonames has no surveyed elevation, it's the average of the terrain around the city. Only loaded with
+	// WithExtendedFields() and zero for MaxMind cities.
+	Elevation int32 `json:"elevation,omitempty"`
+	// Set on Geocode() results that were matched by one of the city's alternate names or one of its neighborhoods (the name that matched).
+	// Empty for direct city name matches.
+	MatchedAlias string `json:"matched_alias,omitempty"`
+	// Whether MatchedAlias is a former name of the city (ie. "Bombay" for Mumbai), useful when geocoding old documents.
+	HistoricAlias bool `json:"historic_alias,omitempty"`
+	// Set on Geocode() results when the query had locality qualifiers that were ignored (ie. "near" for "near Boston").
+	Qualifier string `json:"qualifier,omitempty"`
+	// Whether a Geocode() result matched a city or stands in for a whole region or country.
+	MatchLevel MatchLevel `json:"match_level"`
+}
+
+// What a Geocode() query matched.
+type MatchLevel uint8
+
+const (
+	// The query named a city (or was the best guess at one).
+	MatchCity MatchLevel = iota
+	// The query was only a region (ie. "Texas"). The result is the region's largest city.
+	MatchRegion
+	// The query was only a country (ie. "France"). The result is the country's capital.
+	MatchCountry
+)
+
+// Whether the string is the city's name, either as displayed or in its plain ASCII form (case insensitive).
+// The folded string is the string lowercased with any diacritics removed (see foldLower()), so "Zürich" matches "Zurich" and vice versa.
+func (c GeobedCity) nameIs(s string, folded string) bool {
+	return folded == c.CityLower || strings.EqualFold(s, c.City) || strings.EqualFold(s, c.CityLower)
+}
+
+// Returns a coarse size class for the city, ie. for styling map labels consistently:
+// 0 unknown, 1 under 10k, 2 10k to 100k, 3 100k to 1M, 4 1M to 5M and 5 for 5M or more.
+func (c GeobedCity) PopulationTier() int {
+	switch {
+	case c.Population <= 0:
+		return 0
+	case c.Population < 10000:
+		return 1
+	case c.Population < 100000:
+		return 2
+	case c.Population < 1000000:
+		return 3
+	case c.Population < 5000000:
+		return 4
+	}
+	return 5
 }
 
 // TODO: String interning? (much like converting country code to int)
@@ -145,12 +267,6 @@ type GeobedCity struct {
 // https://github.com/boltdb/bolt/blob/master/bolt_unix.go#L42-L69
 // Maybe even use bolt?
 
-var maxMindCityDedupeIdx map[string][]string
-
-// Holds information about the index ranges for city names (1st and 2nd characters) to help narrow down sets of the GeobedCity slice to scan when looking for a match.
-var cityNameIdx map[string]int
-var locationDedupeIdx map[string]bool
-
 // Information about each country from Geonames including; ISO codes, FIPS, country capital, area (sq km), population, and more.
 // Particularly useful for validating a location string contains a country name which can help the search process.
 // Adding to this info, a slice of partial geohashes to help narrow down reverse geocoding lookups (maps to country buckets).
@@ -179,6 +295,11 @@ type CountryInfo struct {
 // Options when geocoding. For now just an exact match on city name, but there will be potentially other options that can be set to adjust how searching/matching works.
 type GeocodeOptions struct {
 	ExactCity bool
+	// Don't favor cities with larger populations, for when population is irrelevant or misleading (ie. historical data).
+	// Matching is then only by name and region, with ties going to the configured tie breaker (TieBreakSourcePriority if that's TieBreakPopulation).
+	DisablePopulationScoring bool
+	// Favor cities within a geohash area (ie. "9v6" from a coarse IP lookup) over others with the same name. Any prefix length works, invalid ones are ignored.
+	GeohashPrefix string
 }
 
 // An index range struct that's used for narrowing down ranges over the large Cities struct.
@@ -187,64 +308,466 @@ type r struct {
 	t int
 }
 
+// Describes how the cached data dumps were built so that they can be rebuilt when they don't contain what's wanted.
+type cacheMeta struct {
+	Version    int
+	Fields     LoadFields
+	Format     CacheFormat
+	SourceDate time.Time
+	// Whether MaxMind region codes were changed to Geonames ones.
+	RegionCrosswalk bool
+	// The area the cities were limited to, if any.
+	Bounds *BoundingBox
+	// The smallest population of the cities loaded, and whether those with no population were loaded anyway.
+	MinPopulation         int32
+	KeepUnknownPopulation bool
+	// The sources of cities that were loaded, empty for all of them.
+	Sources []string
+	// Whether the city names were normalized with WithNormalize().
+	Normalized bool
+}
+
+// The version of the cached data format. Bump this whenever GeobedCity (or how it's loaded) changes so older caches get rebuilt.
+const cacheVersion = 10
+
 // Creates a new Geobed instance. You do not need more than one. You do not want more than one. There's a fair bit of data to load into memory.
-func NewGeobed() GeoBed {
-	g := GeoBed{}
+// An error is returned (along with whatever did load) when there's no usable data: an ErrDownloadFailed if the data sets couldn't be
+// downloaded, an ErrInvalidData if one couldn't be read (ie. a damaged download), or an ErrEmptyData if they (or the cache) had nothing in
+// them. The latter also matches ErrCacheCorrupt if the cache was damaged too. Startup code can check for these with errors.Is() to decide
+// whether to retry or give up.
+func NewGeobed() (GeoBed, error) {
+	return NewGeobedWithOptions()
+}
 
-	var err error
-	g.c, err = loadGeobedCityData()
-	g.co, err = loadGeobedCountryData()
-	err = loadGeobedCityNameIdx()
-	if err != nil || len(g.c) == 0 {
-		g.downloadDataSets()
-		g.loadDataSets()
-		g.store()
+// Creates a new Geobed instance configured by the given options (see the Option functions).
+func NewGeobedWithOptions(opts ...Option) (GeoBed, error) {
+	g := GeoBed{cfg: newConfig(opts), mu: &sync.RWMutex{}, reloadMu: &sync.Mutex{}, spatial: newSpatialIndex()}
+	g.results = newResultCache(g.cfg.cacheSize)
+
+	// Keep the first thing that went wrong with the cache, it's what's reported if rebuilding fails too.
+	cache := os.DirFS(g.cfg.dataDir)
+	var err, coErr error
+	g.c, err = loadGeobedCityData(cache, g.cfg.cacheFormat)
+	g.co, coErr = loadGeobedCountryData(cache, g.cfg.cacheFormat)
+	if err == nil {
+		err = coErr
+	}
+	var idxErr error
+	g.cityNameIdx, idxErr = loadGeobedCityNameIdx(cache)
+	if err == nil {
+		err = idxErr
+	}
+	g.regionNames, idxErr = loadGeobedRegionNames(cache)
+	if err == nil {
+		err = idxErr
 	}
+	meta, mErr := loadGeobedCacheMeta(cache)
+	// The cache must have been built with (at least) all of the fields wanted.
+	stale := mErr != nil || meta.Version != cacheVersion || meta.Format != g.cfg.cacheFormat || meta.Fields&g.cfg.fields != g.cfg.fields ||
+		meta.RegionCrosswalk != g.cfg.regionCrosswalk || !sameBounds(meta.Bounds, g.cfg.bounds) ||
+		meta.MinPopulation != g.cfg.minPopulation || meta.KeepUnknownPopulation != g.cfg.keepUnknownPopulation ||
+		strings.Join(meta.Sources, ",") != strings.Join(g.cfg.sources, ",") || meta.Normalized != (g.cfg.normalize != nil)
+	g.sourceDate = meta.SourceDate
+	if err != nil || stale || len(g.c) == 0 {
+		g.c = nil
+		g.co = nil
+		g.regionNames = nil
+		g.sourceDate = time.Time{}
+		if dErr := g.downloadDataSets(context.Background()); dErr != nil {
+			// Some of the data sets only add to the others, so carry on without them.
+			if g.requiredDataSetMissing() {
+				return g, dErr
+			}
+			log.Println(dErr)
+		}
+		if lErr := g.loadDataSets(); lErr != nil {
+			return g, lErr
+		}
+		if len(g.c) == 0 || len(g.co) == 0 {
+			if err == nil || errors.Is(err, ErrDataNotFound) {
+				err = errors.New("no cities or countries in the data sets")
+			}
+			return g, wrapErr(ErrEmptyData, err)
+		}
+		if sErr := g.store(); sErr != nil {
+			log.Println(sErr)
+		}
+	} else {
+		if meta.Fields != g.cfg.fields {
+			// The cache has more than what's wanted, drop the extra fields from memory.
+			for k := range g.c {
+				g.cfg.trimFields(&g.c[k])
+			}
+		}
+		// The reverse geocoding index stored with the cache can be used in place of building it.
+		if g.cfg.fields&FieldGeohash != 0 {
+			g.spatial.fsys = cache
+		}
+	}
+	g.indexAltNames()
+	g.indexCountries()
 
-	return g
+	return g, nil
 }
 
-// Downloads the data sets if needed.
-func (g *GeoBed) downloadDataSets() {
-	os.Mkdir("./geobed-data", 0777)
-	for _, f := range dataSetFiles {
-		_, err := os.Stat(f["path"])
-		if err != nil {
-			if os.IsNotExist(err) {
-				// log.Println(f["path"] + " does not exist, downloading...")
-				out, oErr := os.Create(f["path"])
-				defer out.Close()
-				if oErr == nil {
-					r, rErr := http.Get(f["url"])
-					defer r.Body.Close()
-					if rErr == nil {
-						_, nErr := io.Copy(out, r.Body)
-						if nErr != nil {
-							// log.Println("Failed to copy data file, it will be tried again on next application start.")
-							// remove file so another attempt can be made, should something fail
-							err = os.Remove(f["path"])
-						}
-						r.Body.Close()
-					}
-					out.Close()
-				} else {
-					log.Println(oErr)
-				}
+// Creates a new Geobed from a cache built by NewGeobed() (the files it stores in the data directory) that's in a file system, ie. embedded
+// in the binary with go:embed. Nothing is downloaded or written, so it works in read-only containers without network access. g.c.dmp,
+// g.co.dmp and cityNameIdx.dmp have to be there (g.c.bin and g.co.bin for CacheBinary), meta.dmp, regionNames.dmp and spatialIdx.dmp
+// are used if they are. Build the cache with the same options. Errors are ErrDataNotFound if a file that's needed is missing, or
+// ErrCacheCorrupt if one can't be read or the cache is from another version.
+func NewGeobedFromFS(fsys fs.FS, opts ...Option) (GeoBed, error) {
+	g := GeoBed{cfg: newConfig(opts), mu: &sync.RWMutex{}, reloadMu: &sync.Mutex{}, spatial: newSpatialIndex()}
+	g.results = newResultCache(g.cfg.cacheSize)
+
+	// Without meta.dmp, the cache is taken to be what the options say.
+	fields := g.cfg.fields
+	meta, err := loadGeobedCacheMeta(fsys)
+	if err == nil {
+		if meta.Version != cacheVersion {
+			return g, wrapErr(ErrCacheCorrupt, errors.New("the cache is version "+strconv.Itoa(meta.Version)+", not "+strconv.Itoa(cacheVersion)))
+		}
+		g.cfg.cacheFormat = meta.Format
+		fields = meta.Fields
+		g.sourceDate = meta.SourceDate
+	} else if !errors.Is(err, ErrDataNotFound) {
+		return g, err
+	}
+	if g.c, err = loadGeobedCityData(fsys, g.cfg.cacheFormat); err != nil {
+		return g, err
+	}
+	if g.co, err = loadGeobedCountryData(fsys, g.cfg.cacheFormat); err != nil {
+		return g, err
+	}
+	if g.cityNameIdx, err = loadGeobedCityNameIdx(fsys); err != nil {
+		return g, err
+	}
+	// The region names only add to the cities.
+	if g.regionNames, err = loadGeobedRegionNames(fsys); err != nil && !errors.Is(err, ErrDataNotFound) {
+		return g, err
+	}
+	if len(g.c) == 0 || len(g.co) == 0 {
+		return g, wrapErr(ErrEmptyData, errors.New("no cities or countries in the cache"))
+	}
+
+	// Fields that aren't in the cache can't be had, and those in it that aren't wanted are dropped from memory.
+	if fields&^g.cfg.fields != 0 {
+		for k := range g.c {
+			g.cfg.trimFields(&g.c[k])
+		}
+	}
+	g.cfg.fields &= fields
+	if g.cfg.fields&FieldGeohash != 0 {
+		g.spatial.fsys = fsys
+	}
+	g.indexAltNames()
+	g.indexCountries()
+
+	return g, nil
+}
+
+// Indexes the alternate names of all the cities so that a query matching one can be found directly.
+func (g *GeoBed) indexAltNames() {
+	g.altNameIdx = make(map[string][]int)
+	add := func(name string, k int) {
+		// Some alternate names are repeated with different casing.
+		if keys := g.altNameIdx[name]; len(keys) > 0 && keys[len(keys)-1] == k {
+			return
+		}
+		g.altNameIdx[name] = append(g.altNameIdx[name], k)
+	}
+	for k, v := range g.c {
+		// A city with diacritics in its name is also searchable by the plain ASCII form (ie. "Zurich" for "Zürich"), whichever data set it came from.
+		// A custom normalizer can change ASCII names too.
+		if g.cfg.foldNames && (g.cfg.normalize != nil || !isASCII(v.City)) {
+			if f := g.cfg.fold(v.City); f != v.CityLower {
+				add(f, k)
 			}
 		}
+		if v.CityAlt == "" {
+			continue
+		}
+		for _, alt := range strings.Split(v.CityAlt, ",") {
+			alt = strings.TrimSpace(alt)
+			if alt == "" {
+				continue
+			}
+			add(toLower(alt), k)
+			// And alternate names with and without diacritics.
+			if g.cfg.foldNames && (g.cfg.normalize != nil || !isASCII(alt)) {
+				add(g.cfg.fold(alt), k)
+			}
+		}
+	}
+}
+
+// Downloads whichever data sets aren't in the data directory yet, without loading them, so a service can fetch them up front (ie. while
+// starting under a supervisor) and give up if the context is canceled. Any partly downloaded file is removed. NewGeobed() does the same
+// when it needs to, the options should match the ones it's given. Errors are ErrDownloadFailed, and also match context.Canceled or
+// context.DeadlineExceeded if that's why it stopped.
+func DownloadDataSets(ctx context.Context, opts ...Option) error {
+	g := GeoBed{cfg: newConfig(opts)}
+	return g.downloadDataSets(ctx)
+}
+
+// Downloads the data sets if needed. Returns the first download that failed (an ErrDownloadFailed), though all of them are tried unless
+// the context is canceled.
+func (g *GeoBed) downloadDataSets(ctx context.Context) error {
+	if err := os.MkdirAll(g.cfg.dataDir, 0777); err != nil {
+		return wrapErr(ErrDownloadFailed, err)
+	}
+	// One archive with all of the data sets instead.
+	if g.cfg.dataArchive != "" {
+		path := g.cfg.archivePath()
+		if _, err := os.Stat(path); !os.IsNotExist(err) || path == g.cfg.dataArchive {
+			return nil
+		}
+		return wrapErr(ErrDownloadFailed, g.cfg.fetchFile(ctx, g.cfg.dataArchive, path))
+	}
+
+	var firstErr error
+	for _, f := range g.cfg.dataSets() {
+		if err := ctx.Err(); err != nil {
+			return wrapErr(ErrDownloadFailed, err)
+		}
+		path := g.cfg.dataPath(f["path"])
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		// log.Println(path + " does not exist, downloading...")
+		if err := g.cfg.fetchFile(ctx, f["url"], path); err != nil && firstErr == nil {
+			firstErr = wrapErr(ErrDownloadFailed, err)
+		}
 	}
+	return firstErr
 }
 
-// Unzips the data sets and loads the data.
-func (g *GeoBed) loadDataSets() {
-	locationDedupeIdx = make(map[string]bool)
+// The data sets that only describe countries and regions, they're loaded whichever sources of cities are chosen with WithDataSources().
+var supportDataSets = map[string]bool{"geonamesCountryInfo": true, "geonamesAdmin1Codes": true}
 
-	for _, f := range dataSetFiles {
+// The data sets that can't be done without, the others only add to them.
+var requiredDataSets = map[string]bool{"geonamesCities1000": true, "geonamesCountryInfo": true}
+
+// Whether a data set that can't be done without is missing from the data directory, or the data archive is missing if there is one.
+func (g *GeoBed) requiredDataSetMissing() bool {
+	if g.cfg.dataArchive != "" {
+		_, err := os.Stat(g.cfg.archivePath())
+		return err != nil
+	}
+	for _, f := range g.cfg.dataSets() {
+		if _, err := os.Stat(g.cfg.dataPath(f["path"])); err != nil && requiredDataSets[f["id"]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Downloads a file. If anything fails (including the context being canceled), the file is removed so another attempt can be made on the next
+// application start.
+func (cfg config) downloadFile(ctx context.Context, url string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	r, err := cfg.client().Do(req)
+	if err == nil {
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			err = &statusError{url: url, status: r.Status, code: r.StatusCode}
+		} else {
+			var body io.Reader = r.Body
+			if cfg.progress != nil {
+				body = &progressReader{r: r.Body, file: filepath.Base(req.URL.Path), total: r.ContentLength, fn: cfg.progress}
+			}
+			_, err = io.Copy(out, body)
+		}
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// How long to wait before downloading a file again after it failed, doubled after each attempt.
+var downloadBackoff = time.Second
+
+// Downloads a file and checks that it can be read (see checkDataFile()), trying again after a wait if either fails, up to the number of
+// times set by WithDownloadRetries(). A damaged file is removed so it's never loaded, or cached.
+func (cfg config) fetchFile(ctx context.Context, url string, path string) error {
+	wait := downloadBackoff
+	for attempt := 0; ; attempt++ {
+		err := cfg.downloadFile(ctx, url, path)
+		if err == nil {
+			if err = checkDataFile(path); err != nil {
+				os.Remove(path)
+			}
+		}
+		if err == nil || attempt >= cfg.downloadRetries || !retryable(ctx, err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// An HTTP response other than 200 OK to a download.
+type statusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return e.url + ": " + e.status
+}
+
+// Whether a failed download is worth trying again. It isn't once the context is done, or when the server said the file isn't there (or
+// can't be had), only server errors are.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *statusError
+	return !errors.As(err, &se) || se.code >= 500
+}
+
+// Reports how much of a download has been read, see WithProgress().
+type progressReader struct {
+	r     io.Reader
+	file  string
+	done  int64
+	total int64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.fn(p.file, p.done, p.total)
+	}
+	return n, err
+}
+
+// Returns how fresh the loaded data is, the date of the most recent change in the Geonames data set. Zero if it's unknown.
+func (g *GeoBed) SourceDataDate() time.Time {
+	defer g.rlock()()
+	return g.sourceDate
+}
+
+// Checks whether any of the data sets has been published again since it was downloaded, going by the Last-Modified time of the remote
+// file against the downloaded copy's (the same check Update() makes, which will download it). Data loaded from an archive (see
+// WithDataArchive()) is never reported as out of date.
+func (g *GeoBed) UpdateAvailable() (bool, error) {
+	if g.cfg.dataArchive != "" {
+		return false, nil
+	}
+	for _, f := range g.cfg.dataSets() {
+		changed, _, err := g.cfg.dataSetChanged(f)
+		if err != nil || changed {
+			return changed, err
+		}
+	}
+	return false, nil
+}
+
+// Returns the Last-Modified time of a remote file. Errors are ErrDownloadFailed.
+func (cfg config) lastModified(url string) (time.Time, error) {
+	r, err := cfg.client().Head(url)
+	if err != nil {
+		return time.Time{}, wrapErr(ErrDownloadFailed, err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return time.Time{}, wrapErr(ErrDownloadFailed, errors.New(url+": "+r.Status))
+	}
+	lm, err := http.ParseTime(r.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, wrapErr(ErrDownloadFailed, err)
+	}
+	return lm, nil
+}
+
+// A data set geobed loads, as returned by DataSources().
+type DataSource struct {
+	ID  string
+	URL string
+	// Where the file is kept in the data directory.
+	Path string
+	// Whether the file is at Path (ie. it was downloaded or staged there).
+	Downloaded bool
+	// The data archive (see WithDataArchive()) the data set is read from instead of URL and Path, empty if there isn't one.
+	Archive string
+}
+
+// Returns the data sets geobed downloads and loads, where they come from and where they're kept. Useful for auditing or mirroring
+// what will be fetched. Nothing is downloaded.
+func (g *GeoBed) DataSources() []DataSource {
+	sets := g.cfg.dataSets()
+	ds := make([]DataSource, 0, len(sets))
+	for _, f := range sets {
+		s := DataSource{ID: f["id"], URL: f["url"], Path: g.cfg.dataPath(f["path"]), Archive: g.cfg.dataArchive}
+		if _, err := os.Stat(s.Path); err == nil {
+			s.Downloaded = true
+		}
+		ds = append(ds, s)
+	}
+	return ds
+}
+
+// Unzips the data sets and loads the data. Returns an ErrDataNotFound or ErrInvalidData if one of the data sets that can't be done without
+// (see requiredDataSets) couldn't be read, the others are skipped.
+func (g *GeoBed) loadDataSets() error {
+	g.locationDedupeIdx = make(map[string]bool)
+
+	// Data sets in an archive are loaded from it, any that aren't in it are still read from the data directory.
+	var archived map[string][]byte
+	if g.cfg.dataArchive != "" {
+		var err error
+		archived, err = readDataArchive(g.cfg.archivePath())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	for _, f := range g.cfg.dataSets() {
+		if b, ok := archived[f["id"]]; ok {
+			if err := g.loadArchivedDataSet(f["id"], b); err != nil {
+				if requiredDataSets[f["id"]] {
+					return dataSetErr(err)
+				}
+				log.Println(err)
+			}
+			continue
+		}
+		path := g.cfg.dataPath(f["path"])
 		// This one is zipped
 		if f["id"] == "geonamesCities1000" {
-			rz, err := zip.OpenReader(f["path"])
+			// Though a copy that was staged unzipped (or gzipped) can be read as is.
+			if !isZipFile(path) {
+				fi, err := openDataFile(path)
+				if err != nil {
+					return dataSetErr(err)
+				}
+				defer fi.Close()
+
+				g.loadGeonamesCities(fi)
+				continue
+			}
+
+			rz, err := zip.OpenReader(path)
 			if err != nil {
-				log.Fatal(err)
+				return dataSetErr(err)
 			}
 			defer rz.Close()
 
@@ -252,224 +775,72 @@ func (g *GeoBed) loadDataSets() {
 				fi, err := uF.Open()
 
 				if err != nil {
-					log.Fatal(err)
+					return dataSetErr(err)
 				}
 				defer fi.Close()
 
-				// Geonames uses a tab delineated format and it's not even consistent. No CSV reader that I've found for Go can understand this.
-				// I'm not expecting any reader to either because it's an invalid CSV to be frank. However, we can still split up each row by \t
-				scanner := bufio.NewScanner(fi)
-				scanner.Split(bufio.ScanLines)
-
-				i := 1
-				for scanner.Scan() {
-					i++
-
-					// So regexp, sadly, must be used (well, unless I wanted parse each string byte by byte, pushing each into a buffer to append to a slice until a tab is reached, etc.).
-					// But I'd have to also then put in a condition if the next byte was a \t rune, then append an empty string, etc. This just, for now, seems nicer (easier).
-					// This is only an import/update, so it shouldn't be an issue for performance. If it is, then I'll look into other solutions.
-					fields := regexp.MustCompile("\t").Split(scanner.Text(), 19)
-
-					// NOTE: Now using a combined GeobedCity struct since not all data sets have the same fields.
-					// Plus, the entire point was to geocode forward and reverse. Bonus information like elevation and such is just superfluous.
-					// Leaving it here because it may be configurable... If options are passed to NewGeobed() then maybe Geobed can simply be a Geonames search.
-					// Don't even load in MaxMind data...And if that's the case, maybe that bonus information is desired.
-					if len(fields) == 19 {
-						//id, _ := strconv.Atoi(fields[0])
-						lat, _ := strconv.ParseFloat(fields[4], 64)
-						lng, _ := strconv.ParseFloat(fields[5], 64)
-						pop, _ := strconv.Atoi(fields[14])
-						//elv, _ := strconv.Atoi(fields[15])
-						//dem, _ := strconv.Atoi(fields[16])
-
-						gh := geohash.Encode(lat, lng)
-						// This is produced with empty lat/lng values - don't store it.
-						if gh == "7zzzzzzzzzzz" {
-							gh = ""
-						}
-
-						var c GeobedCity
-						c.City = strings.Trim(string(fields[1]), " ")
-						c.CityAlt = string(fields[3])
-						c.Country = string(fields[8])
-						c.Region = string(fields[10])
-						c.Latitude = lat
-						c.Longitude = lng
-						c.Population = int32(pop)
-						c.Geohash = gh
-
-						// Don't include entries without a city name. If we want to geocode the centers of countries and states, then we can do that faster through other means.
-						if len(c.City) > 0 {
-							g.c = append(g.c, c)
-						}
-					}
-				}
+				g.loadGeonamesCities(fi)
 			}
 		}
 
-		// ...And this one is Gzipped (and this one may have worked with the CSV package, but parse it the same way as the others line by line)
+		// ...And this one is Gzipped (and CSV)
 		if f["id"] == "maxmindWorldCities" {
-			// It also has a lot of dupes
-			maxMindCityDedupeIdx = make(map[string][]string)
-
-			fi, err := os.Open(f["path"])
+			fi, err := openDataFile(path)
 			if err != nil {
 				log.Println(err)
+				continue
 			}
 			defer fi.Close()
 
-			fz, err := gzip.NewReader(fi)
+			g.loadMaxMindCities(fi)
+		}
+
+		// Region names only add to the cities, so they can be missing.
+		if f["id"] == "geonamesAdmin1Codes" {
+			fi, err := openDataFile(path)
 			if err != nil {
 				log.Println(err)
+				continue
 			}
-			defer fz.Close()
-
-			scanner := bufio.NewScanner(fz)
-			scanner.Split(bufio.ScanLines)
-
-			i := 1
-			for scanner.Scan() {
-				i++
-				t := scanner.Text()
-
-				fields := strings.Split(t, ",")
-				if len(fields) == 7 {
-					var b bytes.Buffer
-					b.WriteString(fields[0]) // country
-					b.WriteString(fields[3]) // region
-					b.WriteString(fields[1]) // city
-
-					idx := b.String()
-					b.Reset()
-					maxMindCityDedupeIdx[idx] = fields
-				}
-			}
-
-			// Loop the map of fields after dupes have been removed (about 1/5th less... 2.6m vs 3.1m inreases lookup performance).
-			for _, fields := range maxMindCityDedupeIdx {
-				if fields[0] != "" && fields[0] != "0" {
-					if fields[2] != "AccentCity" {
-						pop, _ := strconv.Atoi(fields[4])
-						lat, _ := strconv.ParseFloat(fields[5], 64)
-						lng, _ := strconv.ParseFloat(fields[6], 64)
-						// MaxMind's data set is a bit dirty. I've seen city names surrounded by parenthesis in a few places.
-						cn := strings.Trim(string(fields[2]), " ")
-						cn = strings.Trim(cn, "( )")
-
-						// Don't take any city names with erroneous punctuation either.
-						if strings.Contains(cn, "!") || strings.Contains(cn, "@") {
-							continue
-						}
-
-						gh := geohash.Encode(lat, lng)
-						// This is produced with empty lat/lng values - don't store it.
-						if gh == "7zzzzzzzzzzz" {
-							gh = ""
-						}
+			defer fi.Close()
 
-						// If the geohash was seen before...
-						_, ok := locationDedupeIdx[gh]
-						if !ok {
-							locationDedupeIdx[gh] = true
-
-							var c GeobedCity
-							c.City = cn
-							c.Country = toUpper(string(fields[0]))
-							c.Region = string(fields[3])
-							c.Latitude = lat
-							c.Longitude = lng
-							c.Population = int32(pop)
-							c.Geohash = gh
-
-							// Don't include entries without a city name. If we want to geocode the centers of countries and states, then we can do that faster through other means.
-							if len(c.City) > 0 && len(c.Country) > 0 {
-								g.c = append(g.c, c)
-							}
-						}
-					}
-				}
-			}
-			// Clear out the temrporary index (set to nil, it does get re-created) so that Go can garbage collect it at some point whenever it feels the need.
-			maxMindCityDedupeIdx = nil
-			locationDedupeIdx = nil
+			g.loadGeonamesAdmin1Codes(fi)
 		}
 
 		// ...And this one is just plain text
 		if f["id"] == "geonamesCountryInfo" {
-			fi, err := os.Open(f["path"])
+			fi, err := openDataFile(path)
 
 			if err != nil {
-				log.Fatal(err)
+				return dataSetErr(err)
 			}
 			defer fi.Close()
 
-			scanner := bufio.NewScanner(fi)
-			scanner.Split(bufio.ScanLines)
-
-			i := 1
-			for scanner.Scan() {
-				t := scanner.Text()
-				// There are a bunch of lines in this file that are comments, they start with #
-				if string(t[0]) != "#" {
-					i++
-					fields := regexp.MustCompile("\t").Split(t, 19)
-
-					if len(fields) == 19 {
-						if fields[0] != "" && fields[0] != "0" {
-							isoNumeric, _ := strconv.Atoi(fields[2])
-							area, _ := strconv.Atoi(fields[6])
-							pop, _ := strconv.Atoi(fields[7])
-							gid, _ := strconv.Atoi(fields[16])
-
-							var ci CountryInfo
-							ci.ISO = string(fields[0])
-							ci.ISO3 = string(fields[1])
-							ci.ISONumeric = int16(isoNumeric)
-							ci.Fips = string(fields[3])
-							ci.Country = string(fields[4])
-							ci.Capital = string(fields[5])
-							ci.Area = int32(area)
-							ci.Population = int32(pop)
-							ci.Continent = string(fields[8])
-							ci.Tld = string(fields[9])
-							ci.CurrencyCode = string(fields[10])
-							ci.CurrencyName = string(fields[11])
-							ci.Phone = string(fields[12])
-							ci.PostalCodeFormat = string(fields[13])
-							ci.PostalCodeRegex = string(fields[14])
-							ci.Languages = string(fields[15])
-							ci.GeonameId = int32(gid)
-							ci.Neighbours = string(fields[17])
-							ci.EquivalentFipsCode = string(fields[18])
-
-							g.co = append(g.co, ci)
-						}
-					}
-				}
-			}
+			g.loadGeonamesCountryInfo(fi)
 		}
 	}
 
 	// Sort []GeobedCity by city names to help with binary search (the City field is the most searched upon field and the matching names can be easily filtered down from there).
-	sort.Sort(g.c)
+	// The sort is stable so cities with the same name keep the order they were loaded in (see TieBreakSourcePriority).
+	sort.Stable(g.c)
 
 	//debug
 	//log.Println("TOTAL RECORDS:")
 	//log.Println(len(g.c))
 
 	// Index the locations of city names in the g.c []GeoCity slice. This way when searching the range can be limited so it will be faster.
-	cityNameIdx = make(map[string]int)
+	g.cityNameIdx = make(map[string]int)
 	for k, v := range g.c {
 		// Get the index key for the first character of the city name.
-		ik := toLower(string(v.City[0]))
-		if val, ok := cityNameIdx[ik]; ok {
+		ik := string(v.CityLower[0])
+		if val, ok := g.cityNameIdx[ik]; ok {
 			// If this key number is greater than what was previously recorded, then set it as the new indexed key.
 			if val < k {
-				cityNameIdx[ik] = k
+				g.cityNameIdx[ik] = k
 			}
 		} else {
 			// If the index key has not yet been set for this value, then set it.
-			cityNameIdx[ik] = k
+			g.cityNameIdx[ik] = k
 		}
 
 		// Get the index key for the first two characters of the city name.
@@ -486,55 +857,657 @@ func (g *GeoBed) loadDataSets() {
 		// 	}
 		// }
 	}
+	return nil
+}
+
+// Loads the cities from the Geonames data set.
+func (g *GeoBed) loadGeonamesCities(r io.Reader) {
+	// Geonames uses a tab delineated format and it's not even consistent. No CSV reader that I've found for Go can understand this.
+	// I'm not expecting any reader to either because it's an invalid CSV to be frank. However, we can still split up each row by \t
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	i := 1
+	for scanner.Scan() {
+		i++
+
+		// So regexp, sadly, must be used (well, unless I wanted parse each string byte by byte, pushing each into a buffer to append to a slice until a tab is reached, etc.).
+		// But I'd have to also then put in a condition if the next byte was a \t rune, then append an empty string, etc. This just, for now, seems nicer (easier).
+		// This is only an import/update, so it shouldn't be an issue for performance. If it is, then I'll look into other solutions.
+		fields := regexp.MustCompile("\t").Split(scanner.Text(), 19)
+
+		// NOTE: Now using a combined GeobedCity struct since not all data sets have the same fields.
+		// Plus, the entire point was to geocode forward and reverse. Bonus information like elevation and such is just superfluous.
+		// WithDataSources(SourceGeonames) makes Geobed simply a Geonames search, without loading the MaxMind data at all. Then the bonus information
+		// is there for every city.
+		if len(fields) == 19 {
+			//id, _ := strconv.Atoi(fields[0])
+			lat, _ := strconv.ParseFloat(fields[4], 64)
+			lng, _ := strconv.ParseFloat(fields[5], 64)
+			pop, _ := strconv.Atoi(fields[14])
+			// Most cities have no surveyed elevation, the digital elevation model's is used for those (unless it's no data either).
+			elv, err := strconv.Atoi(fields[15])
+			if err != nil {
+				if dem, _ := strconv.Atoi(fields[16]); dem != demNoData {
+					elv = dem
+				}
+			}
+			// The last column is when the row was last modified, the newest one says how fresh the data is.
+			if mod, err := time.Parse("2006-01-02", strings.TrimSpace(fields[18])); err == nil && mod.After(g.sourceDate) {
+				g.sourceDate = mod
+			}
+			if !g.cfg.inBounds(lat, lng) || !g.cfg.bigEnough(int32(pop)) {
+				continue
+			}
+
+			gh := cityGeohash(lat, lng)
+
+			var c GeobedCity
+			var keep bool
+			c.City, keep = g.cfg.cleanCityName(string(fields[1]))
+			if !keep {
+				continue
+			}
+			c.CityLower = g.cfg.cityLower(c.City, string(fields[2]))
+			c.CityAlt = string(fields[3])
+			c.Country = string(fields[8])
+			c.Region = canonicalRegion(string(fields[10]))
+			c.Latitude = lat
+			c.Longitude = lng
+			c.Population = int32(pop)
+			c.Geohash = gh
+			c.FeatureCode = string(fields[7])
+			c.Timezone = string(fields[17])
+			c.Elevation = int32(elv)
+			g.cfg.trimFields(&c)
+
+			// Don't include entries without a city name. If we want to geocode the centers of countries and states, then we can do that faster through other means.
+			if len(c.City) > 0 {
+				g.c = append(g.c, c)
+			}
+		}
+	}
+}
+
+// The value the Geonames dem column has where there's no elevation data (ie. out at sea).
+const demNoData = -9999
+
+// Loads the cities from the MaxMind world cities data set.
+func (g *GeoBed) loadMaxMindCities(r io.Reader) {
+	// It also has a lot of dupes
+	g.maxMindCityDedupeIdx = make(map[string][]string)
+	if g.locationDedupeIdx == nil {
+		g.locationDedupeIdx = make(map[string]bool)
+	}
+
+	// A CSV reader respects quoted fields, so a city name containing a comma doesn't throw off the field count. Most rows aren't quoted
+	// at all and stray quotes are tolerated.
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Skip over any malformed rows, but stop on anything else (such as a truncated file).
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+			log.Println(err)
+			break
+		}
+
+		if len(fields) == 7 {
+			// Skipping cities outside of the bounding box (or too small) here keeps them out of the dedupe map as well.
+			if g.cfg.bounds != nil {
+				lat, _ := strconv.ParseFloat(fields[5], 64)
+				lng, _ := strconv.ParseFloat(fields[6], 64)
+				if !g.cfg.bounds.contains(lat, lng) {
+					continue
+				}
+			}
+			if g.cfg.minPopulation > 0 {
+				pop, _ := strconv.Atoi(fields[4])
+				if !g.cfg.bigEnough(int32(pop)) {
+					continue
+				}
+			}
+			var b bytes.Buffer
+			b.WriteString(fields[0]) // country
+			b.WriteString(fields[3]) // region
+			b.WriteString(fields[1]) // city
+
+			idx := b.String()
+			b.Reset()
+			g.maxMindCityDedupeIdx[idx] = fields
+		}
+	}
+
+	// Loop the map of fields after dupes have been removed (about 1/5th less... 2.6m vs 3.1m inreases lookup performance).
+	for _, fields := range g.maxMindCityDedupeIdx {
+		if fields[0] != "" && fields[0] != "0" {
+			if fields[2] != "AccentCity" {
+				pop, _ := strconv.Atoi(fields[4])
+				lat, _ := strconv.ParseFloat(fields[5], 64)
+				lng, _ := strconv.ParseFloat(fields[6], 64)
+				cn := string(fields[2])
+				// The file is Latin-1 encoded, convert the accented names to UTF-8.
+				if !utf8.ValidString(cn) {
+					cn = latin1ToUTF8(cn)
+				}
+				// MaxMind's data set is a bit dirty. I've seen city names surrounded by parenthesis in a few places and some with erroneous punctuation.
+				cn, keep := g.cfg.cleanCityName(cn)
+				if !keep {
+					continue
+				}
+
+				gh := cityGeohash(lat, lng)
+
+				// If the geohash was seen before...
+				_, ok := g.locationDedupeIdx[gh]
+				if !ok {
+					g.locationDedupeIdx[gh] = true
+
+					var c GeobedCity
+					c.City = cn
+					// The ASCII city name is used for matching, while the accented one is displayed.
+					c.CityLower = g.cfg.cityLower(c.City, string(fields[1]))
+					c.Country = toUpper(string(fields[0]))
+					c.Region = canonicalRegion(string(fields[3]))
+					if c.Country == "US" {
+						c.Region = usStateCode(c.Region)
+					}
+					if g.cfg.regionCrosswalk {
+						c.Region = GeonamesRegion(c.Country, c.Region)
+					}
+					c.Latitude = lat
+					c.Longitude = lng
+					c.Population = int32(pop)
+					c.Geohash = gh
+					g.cfg.trimFields(&c)
+
+					// Don't include entries without a city name. If we want to geocode the centers of countries and states, then we can do that faster through other means.
+					if len(c.City) > 0 && len(c.Country) > 0 {
+						g.c = append(g.c, c)
+					}
+				}
+			}
+		}
+	}
+	// Clear out the temrporary index (set to nil, it does get re-created) so that Go can garbage collect it at some point whenever it feels the need.
+	g.maxMindCityDedupeIdx = nil
+	g.locationDedupeIdx = nil
+}
+
+// Loads the Geonames country info.
+func (g *GeoBed) loadGeonamesCountryInfo(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	i := 1
+	for scanner.Scan() {
+		t := scanner.Text()
+		// There are a bunch of lines in this file that are comments, they start with #
+		if len(t) > 0 && string(t[0]) != "#" {
+			i++
+			fields := regexp.MustCompile("\t").Split(t, 19)
+
+			if len(fields) == 19 {
+				if fields[0] != "" && fields[0] != "0" {
+					isoNumeric, _ := strconv.Atoi(fields[2])
+					area, _ := strconv.Atoi(fields[6])
+					pop, _ := strconv.Atoi(fields[7])
+					gid, _ := strconv.Atoi(fields[16])
+
+					var ci CountryInfo
+					ci.ISO = string(fields[0])
+					ci.ISO3 = string(fields[1])
+					ci.ISONumeric = int16(isoNumeric)
+					ci.Fips = string(fields[3])
+					ci.Country = string(fields[4])
+					ci.Capital = string(fields[5])
+					ci.Area = int32(area)
+					ci.Population = int32(pop)
+					ci.Continent = string(fields[8])
+					ci.Tld = string(fields[9])
+					ci.CurrencyCode = string(fields[10])
+					ci.CurrencyName = string(fields[11])
+					ci.Phone = string(fields[12])
+					ci.PostalCodeFormat = string(fields[13])
+					ci.PostalCodeRegex = string(fields[14])
+					ci.Languages = string(fields[15])
+					ci.GeonameId = int32(gid)
+					ci.Neighbours = string(fields[17])
+					ci.EquivalentFipsCode = string(fields[18])
+
+					g.co = append(g.co, ci)
+				}
+			}
+		}
+	}
+}
+
+// Loads the Geonames region names, one per line as the country and admin1 code (ie. "US.TX"), the name, the ASCII name and the Geonames id.
+func (g *GeoBed) loadGeonamesAdmin1Codes(r io.Reader) {
+	if g.regionNames == nil {
+		g.regionNames = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			continue
+		}
+		g.regionNames[fields[0]] = fields[1]
+	}
+}
+
+// The first bytes of files in the formats the data sets may be staged in.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// Opens a data set file for reading. Gzipped files are transparently decompressed so that a source can be staged compressed or not.
+func openDataFile(path string) (io.ReadCloser, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(fi)
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return &dataFile{Reader: br, closers: []io.Closer{fi}}, nil
+	}
+
+	fz, err := gzip.NewReader(br)
+	if err != nil {
+		fi.Close()
+		return nil, err
+	}
+	return &dataFile{Reader: fz, closers: []io.Closer{fz, fi}}, nil
+}
+
+// Whether the file at the given path is a zip archive.
+func isZipFile(path string) bool {
+	fi, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fi.Close()
+
+	magic := make([]byte, len(zipMagic))
+	_, err = io.ReadFull(fi, magic)
+	return err == nil && bytes.Equal(magic, zipMagic)
+}
+
+// Checks that a downloaded file can be read all the way through, so a truncated download is caught before it's loaded. Every file in a zip
+// and the whole of a gzip is read, which checks their CRCs (a truncated gzip reads fine up to where it was cut off). Anything else just
+// mustn't be empty.
+func checkDataFile(path string) error {
+	if isZipFile(path) {
+		rz, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer rz.Close()
+		for _, uF := range rz.File {
+			fi, err := uF.Open()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(ioutil.Discard, fi)
+			fi.Close()
+			if err != nil {
+				return errors.New(path + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+
+	fi, err := openDataFile(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	n, err := io.Copy(ioutil.Discard, fi)
+	if err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	if n == 0 {
+		return errors.New(path + " is empty")
+	}
+	return nil
+}
+
+// A data set file being read, possibly through a decompressor. Closing it closes everything underneath.
+type dataFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *dataFile) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
 }
 
 // Forward geocode, location string to lat/lng (returns a struct though)
 func (g *GeoBed) Geocode(n string, opts ...GeocodeOptions) GeobedCity {
+	// variadic optional argument trick
+	options := GeocodeOptions{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	c := g.geocode(n, options)
+	// The hook is free to look things up itself once the lock is released.
+	g.cfg.hookResult(&c)
+	return c
+}
+
+func (g *GeoBed) geocode(n string, options GeocodeOptions) GeobedCity {
+	var c GeobedCity
+	n = cleanQuery(n)
+	if n == "" {
+		return c
+	}
+	defer g.rlock()()
+	key := resultCacheKey{query: n, options: options}
+	if c, ok := g.results.get(key); ok {
+		return c
+	}
+
+	n, qualifier := g.withoutQualifiers(n)
+	n = g.unglued(n)
+
+	if options.ExactCity {
+		c = g.exactMatchCity(n, options)
+	} else if rc, ok := g.regionOrCountryMatch(n); ok {
+		// There's no city in the query to look for.
+		c = rc
+	} else if nc, ok := g.neighborhoodMatch(n); ok {
+		c = nc
+	} else {
+		// NOTE: The downside of this (currently) is that something is basically always returned. It's a best guess.
+		// There's not much chance of it returning "not found" (or an empty GeobedCity struct).
+		// If you'd rather have nothing returned if not found, look at more exact matching options.
+		c = g.fuzzyMatchLocation(n, options)
+	}
+	if c.City != "" {
+		c.Qualifier = qualifier
+	}
+	g.results.add(key, c)
+
+	return c
+}
+
+// Forward geocode, letting the caller adjust the score of each candidate city before the best one is picked, ie. to favor cities where
+// there are stores. rescore gets each city and the score it was given and returns its new score. Returning the score unchanged gives the
+// same city Geocode() would. Only cities are scored, so a query that's just a region or a country doesn't match anything. rescore is
+// called while the data is locked for reading, so it mustn't call any of the GeoBed's own lookups.
+func (g *GeoBed) GeocodeFunc(n string, rescore func(c GeobedCity, baseScore int) int) GeobedCity {
+	c := g.geocodeFunc(n, rescore)
+	g.cfg.hookResult(&c)
+	return c
+}
+
+func (g *GeoBed) geocodeFunc(n string, rescore func(c GeobedCity, baseScore int) int) GeobedCity {
 	var c GeobedCity
-	n = strings.TrimSpace(n)
+	n = cleanQuery(n)
+	if n == "" {
+		return c
+	}
+	defer g.rlock()()
+	n, qualifier := g.withoutQualifiers(n)
+	n = g.unglued(n)
+
+	s := g.scoreLocation(n, GeocodeOptions{}, true)
+	// A city and state match (ie. "Austin, TX") is always the best, so it starts out ahead of everything else.
+	if s.exact != -1 {
+		top := 0
+		for _, v := range s.scores {
+			if v > top {
+				top = v
+			}
+		}
+		s.scores[s.exact] = top + 1
+	}
+	for k, v := range s.scores {
+		s.scores[k] = rescore(s.city(g, k), v)
+	}
+	if ranked := s.ranked(g, g.cfg); len(ranked) > 0 {
+		c = s.city(g, ranked[0])
+		c.Qualifier = qualifier
+	}
+
+	return c
+}
+
+// Forward geocode, favoring cities within the given geohash area (ie. a user's rough location from their IP address).
+// A short prefix is a large area, so this says less about where someone is than exact coordinates would.
+func (g *GeoBed) GeocodeInGeohash(n string, geohashPrefix string) GeobedCity {
+	return g.Geocode(n, GeocodeOptions{GeohashPrefix: geohashPrefix})
+}
+
+// Returns the cities matching a location string grouped by country ISO code, best match first, with up to perCountry cities in each country
+// (no limit if it's less than 1). ie. "Paris" gives Paris, France and Paris, TX in separate groups for a search box to show.
+func (g *GeoBed) GeocodeGrouped(n string, perCountry int, opts ...GeocodeOptions) map[string][]GeobedCity {
+	groups := map[string][]GeobedCity{}
+	n = cleanQuery(n)
+	if n == "" {
+		return groups
+	}
+	defer g.rlock()()
+	options := GeocodeOptions{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	n, _ = g.withoutQualifiers(n)
+	n = g.unglued(n)
+
+	s := g.scoreLocation(n, options, true)
+	ranked := s.ranked(g, g.cfg.forGeocode(options))
+	// A city and state match is always the best.
+	if s.exact != -1 {
+		best := []int{s.exact}
+		for _, k := range ranked {
+			if k != s.exact {
+				best = append(best, k)
+			}
+		}
+		ranked = best
+	}
+	for _, k := range ranked {
+		c := s.city(g, k)
+		if perCountry < 1 || len(groups[c.Country]) < perCountry {
+			groups[c.Country] = append(groups[c.Country], c)
+		}
+	}
+	return groups
+}
+
+// A candidate city for a location string and the score it was given. Higher is better.
+type GeobedMatch struct {
+	City  GeobedCity
+	Score int
+}
+
+// Returns the cities matching a location string with their scores, best first, up to limit of them (no limit if it's less than 1).
+// For a query naming a city, the first is the one Geocode() would give and the rest are for a disambiguation UI to offer. Cities with the same score are ordered by
+// the tie breaker (see WithTieBreak()), so the one with the most people comes first by default.
+func (g *GeoBed) GeocodeN(n string, limit int, opts ...GeocodeOptions) []GeobedMatch {
+	matches := []GeobedMatch{}
+	n = cleanQuery(n)
 	if n == "" {
-		return c
+		return matches
 	}
-	// variadic optional argument trick
+	defer g.rlock()()
 	options := GeocodeOptions{}
 	if len(opts) > 0 {
 		options = opts[0]
 	}
+	n, _ = g.withoutQualifiers(n)
+	n = g.unglued(n)
+
+	s := g.scoreLocation(n, options, true)
+	// A city and state match is always the best, so it goes ahead of everything else.
+	if s.exact != -1 {
+		top := 0
+		for _, v := range s.scores {
+			if v > top {
+				top = v
+			}
+		}
+		s.scores[s.exact] = top + 1
+	}
+	for _, k := range s.ranked(g, g.cfg.forGeocode(options)) {
+		if limit > 0 && len(matches) == limit {
+			break
+		}
+		matches = append(matches, GeobedMatch{City: s.city(g, k), Score: s.scores[k]})
+	}
+	return matches
+}
 
-	if options.ExactCity {
-		c = g.exactMatchCity(n)
-	} else {
-		// NOTE: The downside of this (currently) is that something is basically always returned. It's a best guess.
-		// There's not much chance of it returning "not found" (or an empty GeobedCity struct).
-		// If you'd rather have nothing returned if not found, look at more exact matching options.
-		c = g.fuzzyMatchLocation(n)
+// The confidence GeocodeApproximate() wants before it trusts a match.
+const approximateMinConfidence = 0.5
+
+// Geocodes something that may be more than a location, like a full street address, and says how much to trust the city it found.
+// The confidence (0 to 1) is how much of the city's name (or the alternate name that matched) is in the query word for word, since
+// Geocode() always makes a best guess and a city that only partly matches is likely wrong. ie. "123 Main St, Austin, TX 78701" is
+// 1 for Austin while a query naming a town that isn't loaded gets a low confidence for whatever similarly named city was picked.
+// Queries matching a whole region or country are 1. The bool is whether the confidence is high enough to use the city.
+func (g *GeoBed) GeocodeApproximate(n string) (GeobedCity, float64, bool) {
+	c := g.Geocode(n)
+	if c.City == "" {
+		return c, 0, false
+	}
+	if c.MatchLevel != MatchCity {
+		return c, 1, true
+	}
+	name := c.City
+	if c.MatchedAlias != "" {
+		name = c.MatchedAlias
+	}
+	words := map[string]bool{}
+	for _, w := range strings.Fields(cleanQuery(n)) {
+		words[g.cfg.fold(strings.Trim(w, ",.;:()"))] = true
 	}
+	nameWords := strings.Fields(g.cfg.fold(name))
+	found := 0
+	for _, w := range nameWords {
+		if words[w] {
+			found++
+		}
+	}
+	confidence := 0.0
+	if len(nameWords) > 0 {
+		confidence = float64(found) / float64(len(nameWords))
+	}
+	return c, confidence, confidence >= approximateMinConfidence
+}
 
-	return c
+// How many points below the best match a city can score and still count towards a query's ambiguity.
+const ambiguityMargin = 2
+
+// Returns how many distinct cities (by name, region and country) are close contenders for a location string, as scored by Geocode().
+// 1 means the query is clear, a higher number means the caller may want to ask the user which one they meant. 0 if nothing matched.
+func (g *GeoBed) Ambiguity(n string) int {
+	n = cleanQuery(n)
+	if n == "" {
+		return 0
+	}
+	defer g.rlock()()
+	n, _ = g.withoutQualifiers(n)
+	n = g.unglued(n)
+	s := g.scoreLocation(n, GeocodeOptions{}, false)
+	if s.exact != -1 {
+		return 1
+	}
+	top := 0
+	for _, v := range s.scores {
+		if v > top {
+			top = v
+		}
+	}
+	distinct := map[string]bool{}
+	for k, v := range s.scores {
+		if v >= top-ambiguityMargin {
+			distinct[g.c[k].CityLower+"|"+g.c[k].Region+"|"+g.c[k].Country] = true
+		}
+	}
+	return len(distinct)
+}
+
+// Words that describe a location relative to a city (ie. "near Boston" or "greater London") rather than being part of its name.
+var localityQualifiers = map[string]bool{
+	"near":     true,
+	"greater":  true,
+	"outside":  true,
+	"downtown": true,
+	"metro":    true,
+}
+
+// Words like "near" or "greater" only add noise when matching, so they're removed from a query unless they're part of a city's name
+// (ie. "Greater Sudbury"). Returns the query to match and the qualifiers that were removed. Stopwords are removed as well.
+func (g *GeoBed) withoutQualifiers(n string) (string, string) {
+	n = g.withoutStopwords(n)
+	nq, qualifier := stripQualifiers(n)
+	if qualifier == "" || len(g.citiesByName(n)) > 0 {
+		return n, ""
+	}
+	return nq, qualifier
+}
+
+// Removes locality qualifiers from a query. Returns the query without them and the qualifiers that were removed (lowercase, space separated).
+// The query is returned unchanged if it's nothing but qualifiers.
+func stripQualifiers(n string) (string, string) {
+	words := strings.Fields(n)
+	kept := []string{}
+	qualifiers := []string{}
+	for _, w := range words {
+		if q := toLower(strings.Trim(w, ",.:")); localityQualifiers[q] {
+			qualifiers = append(qualifiers, q)
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	if len(qualifiers) == 0 || len(kept) == 0 {
+		return n, ""
+	}
+	return strings.Trim(strings.Join(kept, " "), " ,"), strings.Join(qualifiers, " ")
 }
 
 // Returns a GeobedCity only if there is an exact city name match. A stricter match, though if state or country are missing a guess will be made.
-func (g *GeoBed) exactMatchCity(n string) GeobedCity {
+func (g *GeoBed) exactMatchCity(n string, options GeocodeOptions) GeobedCity {
 	var c GeobedCity
+	cfg := g.cfg.forGeocode(options)
 	// Ignore the `abbrevSlice` value for now. Use `nCo` and `nSt` for more accuracy.
 	nCo, nSt, _, nSlice := g.extractLocationPieces(n)
 	nWithoutAbbrev := strings.Join(nSlice, " ")
-	ranges := g.getSearchRange(nSlice)
+	nFold := g.cfg.fold(n)
+	nWithoutAbbrevFold := g.cfg.fold(nWithoutAbbrev)
+	ranges := g.getSearchRange(g.cfg.foldSlice(nSlice))
 
 	matchingCities := []GeobedCity{}
 
 	// First, get everything that matches the city exactly (case insensitive).
 	for _, rng := range ranges {
-		// When adjusting the range, the keys become out of sync. Start from rng.f
-		currentKey := rng.f
 		for _, v := range g.c[rng.f:rng.t] {
-			currentKey++
 			// The full string (ie. "New York" or "Las Vegas")
-			if strings.EqualFold(n, v.City) {
+			if v.nameIs(n, nFold) {
 				matchingCities = append(matchingCities, v)
 			}
 			// The pieces with abbreviations removed
-			if strings.EqualFold(nWithoutAbbrev, v.City) {
+			if v.nameIs(nWithoutAbbrev, nWithoutAbbrevFold) {
 				matchingCities = append(matchingCities, v)
 			}
 			// Each piece - doesn't make sense for now. May revisit this.
@@ -548,6 +1521,17 @@ func (g *GeoBed) exactMatchCity(n string) GeobedCity {
 		}
 	}
 
+	// A country given in the query rules out cities elsewhere, even if that leaves nothing.
+	if nCo != "" {
+		inCountry := matchingCities[:0]
+		for _, city := range matchingCities {
+			if city.Country == nCo {
+				inCountry = append(inCountry, city)
+			}
+		}
+		matchingCities = inCountry
+	}
+
 	// If only one was found, we can stop right here.
 	if len(matchingCities) == 1 {
 		return matchingCities[0]
@@ -581,13 +1565,17 @@ func (g *GeoBed) exactMatchCity(n string) GeobedCity {
 
 			// If someone says, "New York, USA" they most likely mean New York, NY because it's the largest city.
 			// Specific locations are often implied based on size or popularity even though the names aren't unique.
-			biggestCity := GeobedCity{}
-			for _, city := range matchingCountryCities {
-				if city.Population > biggestCity.Population {
-					biggestCity = city
+			// Other tie breakers can be configured if population data isn't trusted.
+			best := -1
+			for i := range matchingCountryCities {
+				if best == -1 || cfg.winsTie(&matchingCountryCities[i], &matchingCountryCities[best], i, best) {
+					best = i
 				}
 			}
-			c = biggestCity
+			// Without population data there's nothing to go on when guessing the biggest city.
+			if best >= 0 && (cfg.tieBreak != TieBreakPopulation || matchingCountryCities[best].Population > 0) {
+				c = matchingCountryCities[best]
+			}
 		}
 	}
 
@@ -595,25 +1583,147 @@ func (g *GeoBed) exactMatchCity(n string) GeobedCity {
 }
 
 // When geocoding, this provides a scored best match.
-func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
+func (g *GeoBed) fuzzyMatchLocation(n string, options GeocodeOptions) GeobedCity {
+	s := g.scoreLocation(n, options, false)
+	// Strings like "Austin, TX" need no guessing.
+	if s.exact != -1 {
+		return g.c[s.exact]
+	}
+
+	var bestMatchingKey = 0
+	if ranked := s.ranked(g, g.cfg.forGeocode(options)); len(ranked) > 0 {
+		bestMatchingKey = ranked[0]
+	} else if s.country != "" {
+		// Nothing in the country that was asked for, a city elsewhere would be wrong (ie. "Someville, France").
+		return GeobedCity{}
+	}
+
+	// debug
+	// log.Println("Possible results:")
+	// log.Println(len(s.scores))
+	// log.Println("Best match:")
+	// log.Println(g.c[bestMatchingKey])
+	// log.Println("Scored:")
+	// log.Println(s.scores[bestMatchingKey])
+
+	return s.city(g, bestMatchingKey)
+}
+
+// The scores of the cities that are candidates for a query, keyed by their keys in g.c.
+type locationScores struct {
+	scores map[int]int
+	// The alternate name that matched for each key, if any.
+	aliases map[int]string
+	// The key of a city that matches the city and state exactly (ie. "Austin, TX"), otherwise -1.
+	exact int
+	// The country (ISO code) named in the query, if any. Only cities in it are scored.
+	country string
+}
+
+// Returns the keys of the scored cities, best first. Cities with the same score are ordered by the tie breaker.
+func (s locationScores) ranked(g *GeoBed, cfg config) []int {
+	keys := make([]int, 0, len(s.scores))
+	for k := range s.scores {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if s.scores[a] != s.scores[b] {
+			return s.scores[a] > s.scores[b]
+		}
+		// If there is a tie breaker, by default use the city with the higher population (if known) because it's more likely to be what is meant.
+		// For example, when people say "New York" they typically mean New York, NY...Though there are many New Yorks.
+		return cfg.winsTie(&g.c[a], &g.c[b], a, b)
+	})
+	return keys
+}
+
+// Returns a scored city, letting the caller know when an alternate name is what matched (ie. "NYC" for New York City).
+func (s locationScores) city(g *GeoBed, k int) GeobedCity {
+	c := g.c[k]
+	if alias, ok := s.aliases[k]; ok && !strings.EqualFold(alias, c.City) {
+		c.MatchedAlias = alias
+		c.HistoricAlias = historicNames[foldLower(alias)]
+	}
+	return c
+}
+
+// Scores the cities that could be what a location string refers to. Scoring stops at a city that matches the city and state exactly
+// (ie. "Austin, TX") unless all is true.
+func (g *GeoBed) scoreLocation(n string, options GeocodeOptions, all bool) locationScores {
+	exact := -1
 	nCo, nSt, abbrevSlice, nSlice := g.extractLocationPieces(n)
+	// City names are matched with diacritics folded as well, against the plain ASCII names (ie. "Zürich" matches "Zurich").
+	nSliceFold := g.cfg.foldSlice(nSlice)
 	// Take the reamining unclassified pieces (those not likely to be abbreviations) and get our search range.
 	// These pieces are likely contain the city name. Narrowing down the search range will make the lookup faster.
-	ranges := g.getSearchRange(nSlice)
+	ranges := g.getSearchRange(nSliceFold)
+	// The pieces left over after removing any state or country, ie. "Austin" from "Austin, TX"
+	nCity := strings.TrimSuffix(strings.Join(nSlice, " "), ",")
+	// Cities like "North Las Vegas" get fragmented into pieces that better match "Las Vegas", so keep the full name when it starts with a direction.
+	dirCity, hasDir := directionalCityName(nSlice)
+	if hasDir {
+		nCity = dirCity
+	}
+	nFold := g.cfg.fold(n)
+	nCityFold := g.cfg.fold(nCity)
+	dirCityFold := g.cfg.fold(dirCity)
+	// Repeated words (ie. "New York New York") only count once, otherwise they inflate the score of every city containing them.
+	repeated := make([]bool, len(nSliceFold))
+	seenPieces := map[string]bool{}
+	for k, ns := range nSliceFold {
+		repeated[k] = seenPieces[ns]
+		seenPieces[ns] = true
+	}
 
 	var bestMatchingKeys = map[int]int{}
-	var bestMatchingKey = 0
+	// The alternate name that matched for each key, if any.
+	var matchedAliases = map[int]string{}
+
+	// When the whole query is one of a city's alternate names, that's about as good as matching the city name (ie. "NYC" or "Big Apple").
+	// These cities are found through the index since they can be outside the search ranges.
+	altScored := map[int]bool{}
+	for _, q := range uniqueLower(n, nCity, nFold, nCityFold) {
+		for _, k := range g.altNameIdx[q] {
+			// Don't score a city twice when the query and its folded form both match.
+			if altScored[k] || (nCo != "" && nCo != g.c[k].Country) {
+				continue
+			}
+			altScored[k] = true
+			if val, ok := bestMatchingKeys[k]; ok {
+				bestMatchingKeys[k] = val + 7
+			} else {
+				bestMatchingKeys[k] = 7
+			}
+			// Keep the alternate name as the city has it.
+			for _, alt := range strings.Split(g.c[k].CityAlt, ",") {
+				alt = strings.TrimSpace(alt)
+				if strings.EqualFold(alt, q) || g.cfg.fold(alt) == q {
+					matchedAliases[k] = alt
+					break
+				}
+			}
+		}
+	}
 	for _, rng := range ranges {
-		// When adjusting the range, the keys become out of sync. Start from rng.f
-		currentKey := rng.f
-
-		for _, v := range g.c[rng.f:rng.t] {
-			currentKey++
+		for i, v := range g.c[rng.f:rng.t] {
+			// When adjusting the range, the keys become out of sync. Offset from rng.f
+			currentKey := rng.f + i
 
 			// Mainly useful for strings like: "Austin, TX" or "Austin TX" (locations with US state codes). Smile if your location string is this simple.
+			// A country named in the query rules out cities elsewhere.
+			if nCo != "" && nCo != v.Country {
+				continue
+			}
+
 			if nSt != "" {
-				if strings.EqualFold(n, v.City) && strings.EqualFold(nSt, v.Region) {
-					return v
+				if v.nameIs(nCity, nCityFold) && strings.EqualFold(nSt, v.Region) {
+					if !all {
+						return locationScores{exact: currentKey, country: nCo}
+					}
+					if exact == -1 {
+						exact = currentKey
+					}
 				}
 			}
 
@@ -638,6 +1748,9 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 			// Abbreviations for state/country
 			// Region (state/province)
 			for _, av := range abbrevSlice {
+				// A US state code in a US location is the state, not a country (ie. "IN" is Indiana rather than India).
+				_, isState := UsSateCodes[toUpper(av)]
+				usState := isState && (nSt != "" || nCo == "US")
 				lowerAv := toLower(av)
 				if len(av) == 2 && strings.EqualFold(v.Region, lowerAv) {
 					if val, ok := bestMatchingKeys[currentKey]; ok {
@@ -648,7 +1761,7 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 				}
 
 				// Country (worth 2 points if exact match)
-				if len(av) == 2 && strings.EqualFold(v.Country, lowerAv) {
+				if len(av) == 2 && !usState && strings.EqualFold(v.Country, lowerAv) {
 					if val, ok := bestMatchingKeys[currentKey]; ok {
 						bestMatchingKeys[currentKey] = val + 3
 					} else {
@@ -681,7 +1794,8 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 
 			// If any alternate names can be discovered, take them into consideration.
 			if v.CityAlt != "" {
-				alts := strings.Fields(v.CityAlt)
+				// Alternate names are comma separated and can be multiple words themselves (ie. "New York City").
+				alts := strings.Split(v.CityAlt, ",")
 				for _, altV := range alts {
 					if strings.EqualFold(altV, n) {
 						if val, ok := bestMatchingKeys[currentKey]; ok {
@@ -689,6 +1803,7 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 						} else {
 							bestMatchingKeys[currentKey] = 3
 						}
+						matchedAliases[currentKey] = altV
 					}
 					// Exact, a case-sensitive match means a lot.
 					if altV == n {
@@ -702,7 +1817,16 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 			}
 
 			// Exact city name matches mean a lot.
-			if strings.EqualFold(n, v.City) {
+			if v.nameIs(n, nFold) {
+				if val, ok := bestMatchingKeys[currentKey]; ok {
+					bestMatchingKeys[currentKey] = val + 7
+				} else {
+					bestMatchingKeys[currentKey] = 7
+				}
+			}
+
+			// So does an exact match on a city name starting with a direction (with any state/country removed).
+			if hasDir && !v.nameIs(n, nFold) && v.nameIs(dirCity, dirCityFold) {
 				if val, ok := bestMatchingKeys[currentKey]; ok {
 					bestMatchingKeys[currentKey] = val + 7
 				} else {
@@ -710,11 +1834,15 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 				}
 			}
 
-			for _, ns := range nSlice {
+			for k, ns := range nSlice {
 				ns = strings.TrimSuffix(ns, ",")
+				// The direction itself is part of the city name, not a piece to match on its own (many city names contain "North").
+				if (hasDir && k == 0) || repeated[k] {
+					continue
+				}
 
 				// City (worth 2 points if contians part of string)
-				if strings.Contains(toLower(v.City), toLower(ns)) {
+				if strings.Contains(toLower(v.City), toLower(ns)) || strings.Contains(v.CityLower, nSliceFold[k]) {
 					if val, ok := bestMatchingKeys[currentKey]; ok {
 						bestMatchingKeys[currentKey] = val + 2
 					} else {
@@ -724,7 +1852,7 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 
 				// If there's an exat match, maybe there was noise in the string so it could be the full city name, but unlikely. For example, "New" or "Los" is in many city names.
 				// Still, give it a point because it could be the bulkier part of a city name (or the city name could be one word). This has helped in some cases.
-				if strings.EqualFold(v.City, ns) {
+				if v.nameIs(ns, nSliceFold[k]) {
 					if val, ok := bestMatchingKeys[currentKey]; ok {
 						bestMatchingKeys[currentKey] = val + 1
 					} else {
@@ -736,8 +1864,19 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 		}
 	}
 
+	// No city has a name in the query, so it may be misspelled (see WithFuzzyMatch()).
+	if g.cfg.fuzzyDistance > 0 {
+		names := append([]string{nFold, nCityFold}, nSliceFold...)
+		if hasDir {
+			names = append(names, dirCityFold)
+		}
+		if !g.anyNamed(bestMatchingKeys, matchedAliases, names) && len(altScored) == 0 {
+			g.scoreMisspelled(bestMatchingKeys, ranges, nCo, names)
+		}
+	}
+
 	// If no country was found, look at population as a factor. Is it obvious?
-	if nCo == "" {
+	if nCo == "" && !options.DisablePopulationScoring {
 		hp := int32(0)
 		hpk := 0
 		for k, v := range bestMatchingKeys {
@@ -757,61 +1896,48 @@ func (g *GeoBed) fuzzyMatchLocation(n string) GeobedCity {
 		}
 	}
 
-	m := 0
-	for k, v := range bestMatchingKeys {
-		if v > m {
-			m = v
-			bestMatchingKey = k
+	// A city with the name asked for in the area the caller is in is more likely than one with the same name elsewhere, however big.
+	// Those are moved ahead of all the others (keeping their order), but a city only partly matching the name doesn't get ahead this way.
+	if p := toLower(options.GeohashPrefix); validGeohash(p) {
+		top := 0
+		for _, v := range bestMatchingKeys {
+			if v > top {
+				top = v
+			}
 		}
-
-		// If there is a tie breaker, use the city with the higher population (if known) because it's more likely to be what is meant.
-		// For example, when people say "New York" they typically mean New York, NY...Though there are many New Yorks.
-		if v == m {
-			if g.c[k].Population > g.c[bestMatchingKey].Population {
-				bestMatchingKey = k
+		for k, v := range bestMatchingKeys {
+			_, aliased := matchedAliases[k]
+			if strings.HasPrefix(g.c[k].Geohash, p) && (aliased || g.c[k].nameIs(nCity, nCityFold) || g.c[k].nameIs(n, nFold)) {
+				bestMatchingKeys[k] = v + top
 			}
 		}
 	}
 
-	// debug
-	// log.Println("Possible results:")
-	// log.Println(len(bestMatchingKeys))
-	// for _, kv := range bestMatchingKeys {
-	// 	log.Println(g.c[kv])
-	// }
-	// log.Println("Best match:")
-	// log.Println(g.c[bestMatchingKey])
-	// log.Println("Scored:")
-	// log.Println(m)
-
-	return g.c[bestMatchingKey]
+	return locationScores{scores: bestMatchingKeys, aliases: matchedAliases, exact: exact, country: nCo}
 }
 
 // Splits a string up looking for potential abbreviations by matching against a shorter list of abbreviations.
 // Returns country, state, a slice of strings with potential abbreviations (based on size; 2 or 3 characters), and then a slice of the remaning pieces.
 // This does a good job at separating things that are clearly abbreviations from the city so that searching is faster and more accuarate.
 func (g *GeoBed) extractLocationPieces(n string) (string, string, []string, []string) {
-	var re = regexp.MustCompile("")
-
 	// Extract all potential abbreviations.
-	re = regexp.MustCompile(`[\S]{2,3}`)
-	abbrevSlice := re.FindStringSubmatch(n)
+	abbrevSlice := abbrevPattern.FindStringSubmatch(n)
 
 	// Convert country to country code and pull it out. We'll use it as a secondary form of validation. Remove the code from the original query.
 	nCo := ""
-	for _, co := range g.co {
-		re = regexp.MustCompile("(?i)^" + co.Country + ",?\\s|\\s" + co.Country + ",?\\s" + co.Country + "\\s$")
-		if re.MatchString(n) {
-			nCo = co.ISO
+	for _, cp := range g.countryPatterns {
+		if cp.re.MatchString(n) {
+			nCo = cp.iso
 			// And remove it so we have a cleaner query string for a city.
-			n = re.ReplaceAllString(n, "")
+			n = strings.Join(strings.Fields(cp.re.ReplaceAllString(n, " ")), " ")
+			break
 		}
 	}
 
 	// Find US State codes and pull them out as well (do not convert state names, they can also easily be city names).
 	nSt := ""
 	for sc, _ := range UsSateCodes {
-		re = regexp.MustCompile("(?i)^" + sc + ",?\\s|\\s" + sc + ",?\\s|\\s" + sc + "$")
+		re := usStatePattern(sc)
 		if re.MatchString(n) {
 			nSt = sc
 			// And remove it too.
@@ -829,6 +1955,68 @@ func (g *GeoBed) extractLocationPieces(n string) (string, string, []string, []st
 	return nCo, nSt, abbrevSlice, nSlice
 }
 
+var abbrevPattern = regexp.MustCompile(`[\S]{2,3}`)
+
+// The patterns finding each US state code in a location string, compiled the first time they're needed and shared by every GeoBed
+// (regular expressions are safe to use from several goroutines). Compiling them for every query was most of the time Geocode() took.
+var usStatePatterns sync.Map
+
+func usStatePattern(sc string) *regexp.Regexp {
+	if re, ok := usStatePatterns.Load(sc); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, _ := usStatePatterns.LoadOrStore(sc, regexp.MustCompile("(?i)^"+sc+",?\\s|\\s"+sc+",?\\s|\\s"+sc+"$"))
+	return re.(*regexp.Regexp)
+}
+
+// Returns the lowercase versions of the strings without any duplicates.
+func uniqueLower(strs ...string) []string {
+	u := []string{}
+	seen := map[string]bool{}
+	for _, s := range strs {
+		s = toLower(s)
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+	return u
+}
+
+// Directional words that commonly begin city names (ie. "North Las Vegas" or "West Palm Beach") and their abbreviations.
+var directionalWords = map[string]string{
+	"north": "North",
+	"south": "South",
+	"east":  "East",
+	"west":  "West",
+	"n":     "North",
+	"s":     "South",
+	"e":     "East",
+	"w":     "West",
+}
+
+// If the pieces start with a direction (and there's more to the name), returns them joined back together as a city name with the direction spelled out.
+func directionalCityName(nSlice []string) (string, bool) {
+	if len(nSlice) < 2 {
+		return "", false
+	}
+	dir, ok := directionalWords[toLower(strings.TrimRight(nSlice[0], "."))]
+	if !ok {
+		return "", false
+	}
+	pieces := []string{dir}
+	for _, ns := range nSlice[1:] {
+		ns = strings.TrimSuffix(ns, ",")
+		if ns != "" {
+			pieces = append(pieces, ns)
+		}
+	}
+	if len(pieces) < 2 {
+		return "", false
+	}
+	return strings.Join(pieces, " "), true
+}
+
 // There's potentially 2.7 million items to range though, let's see if we can reduce that by taking slices of the slice in alphabetical order.
 func (g *GeoBed) getSearchRange(nSlice []string) []r {
 	// NOTE: A simple binary search was not helping here since we aren't looking for one specific thing. We have multiple elements, city, state, country.
@@ -847,44 +2035,163 @@ func (g *GeoBed) getSearchRange(nSlice []string) []r {
 			// To/from key
 			fk := 0
 			tk := 0
-			if val, ok := cityNameIdx[pik]; ok {
+			if val, ok := g.cityNameIdx[pik]; ok {
 				fk = val
 			}
-			if val, ok := cityNameIdx[fc]; ok {
-				tk = val
+			// The index holds the last key for the character, so go one past it (the range end is exclusive).
+			if val, ok := g.cityNameIdx[fc]; ok {
+				tk = val + 1
 			}
 			// Don't let the to key be out of range.
 			if tk == 0 {
-				tk = (len(g.c) - 1)
+				tk = len(g.c)
+			}
+			// Pieces starting with the same letter share a range, which would otherwise be scanned (and scored) more than once.
+			if !containsRange(ranges, r{fk, tk}) {
+				ranges = append(ranges, r{fk, tk})
 			}
-			ranges = append(ranges, r{fk, tk})
 		}
 	}
 
 	return ranges
 }
 
+func containsRange(ranges []r, rng r) bool {
+	for _, v := range ranges {
+		if v == rng {
+			return true
+		}
+	}
+	return false
+}
+
 func prev(r rune) rune {
 	return r - 1
 }
 
 // Reverse geocode
 func (g *GeoBed) ReverseGeocode(lat float64, lng float64) GeobedCity {
+	c, _ := g.lockedReverseGeocode(context.Background(), lat, lng, nil)
+	return c
+}
+
+// Reverse geocode the center of the geohash cell (of the given number of characters, 1 to 12) the lat/lng falls in. Every point in a cell
+// gives the same result, so results can be cached by geohash when there are lots of nearby points (ie. from low precision GPS).
+// A precision of 5 is a cell of about 5km and 6 is about 1km.
+func (g *GeoBed) ReverseGeocodeRounded(lat float64, lng float64, precision int) GeobedCity {
+	if checkCoordinate(lat, lng) != nil {
+		return GeobedCity{}
+	}
+	if precision < 1 {
+		precision = 1
+	}
+	gh := EncodeGeohash(lat, lng)
+	if precision < len(gh) {
+		gh = gh[:precision]
+	}
+	return g.ReverseGeocode(DecodeGeohash(gh))
+}
+
+// Reverse geocode, giving up when the context is canceled (or its deadline passes). This keeps the scan over a large data set bounded.
+// Returns an ErrInvalidCoordinate error for a lat/lng that's out of range.
+func (g *GeoBed) ReverseGeocodeContext(ctx context.Context, lat float64, lng float64) (GeobedCity, error) {
+	return g.lockedReverseGeocode(ctx, lat, lng, nil)
+}
+
+// Reverse geocode, only considering cities in the given country (ISO code). This is faster and keeps a coordinate near a border from
+// returning a city in the wrong country when the country is already known. Returns an empty GeobedCity if no city in the country is nearby.
+func (g *GeoBed) ReverseGeocodeInCountry(lat float64, lng float64, iso string) GeobedCity {
+	c, _ := g.lockedReverseGeocode(context.Background(), lat, lng, func(c *GeobedCity) bool {
+		return strings.EqualFold(c.Country, iso)
+	})
+	return c
+}
+
+// Returns the nearest city with one of the given Geonames feature codes, ie. []string{"PPLA"} for the nearest seat of a first-level
+// administrative division or []string{"PPLC"} for the nearest capital. Unlike ReverseGeocode(), the city can be any distance away.
+// The second value is false if no city has any of the feature codes (or FieldFeatureCode wasn't loaded).
+func (g *GeoBed) ReverseGeocodeByFeature(lat float64, lng float64, featureCodes []string) (GeobedCity, bool) {
+	if checkCoordinate(lat, lng) != nil {
+		return GeobedCity{}, false
+	}
+	defer g.rlock()()
+	codes := map[string]bool{}
+	for _, fc := range featureCodes {
+		codes[toUpper(fc)] = true
+	}
+
+	ck := -1
+	closest := 0.0
+	for k, v := range g.c {
+		if !codes[v.FeatureCode] {
+			continue
+		}
+		d := Distance(lat, lng, v.Latitude, v.Longitude)
+		if ck == -1 || d < closest {
+			ck = k
+			closest = d
+		}
+	}
+	if ck == -1 {
+		return GeobedCity{}, false
+	}
+	return g.c[ck], true
+}
+
+// How many cities to scan between checks for a canceled context.
+const ctxCheckInterval = 4096
+
+// Reverse geocodes with the data locked, then runs the result hook (which is free to look things up itself) once it's unlocked.
+func (g *GeoBed) lockedReverseGeocode(ctx context.Context, lat float64, lng float64, filter func(c *GeobedCity) bool) (GeobedCity, error) {
+	unlock := g.rlock()
+	c, err := g.reverseGeocode(ctx, lat, lng, filter)
+	unlock()
+	g.cfg.hookResult(&c)
+	return c, err
+}
+
+// Finds the city closest to the lat/lng by geohash, out of those the filter (if any) allows.
+func (g *GeoBed) reverseGeocode(ctx context.Context, lat float64, lng float64, filter func(c *GeobedCity) bool) (GeobedCity, error) {
 	c := GeobedCity{}
+	if err := checkCoordinate(lat, lng); err != nil {
+		return c, err
+	}
+	// Without geohashes there's nothing to match on.
+	if g.cfg.fields&FieldGeohash == 0 {
+		return c, nil
+	}
 
-	gh := geohash.Encode(lat, lng)
-	// This is produced with empty lat/lng values - don't look for anything.
-	if gh == "7zzzzzzzzzzz" {
-		return c
+	// That's where cities without coordinates would be, there's nothing real to find.
+	if lat == 0 && lng == 0 {
+		return c, nil
 	}
+	gh := geohash.Encode(lat, lng)
 
 	// Note: All geohashes are going to be 12 characters long. Even if the precision on the lat/lng isn't great. The geohash package will center things.
 	// Obviously lat/lng like 37, -122 is a guess. That's no where near the resolution of a city. Though we're going to allow guesses.
 	mostMatched := 0
 	matched := 0
-	for k, v := range g.c {
-		// check first two characters to reduce the number of loops
-		if v.Geohash[0] == gh[0] && v.Geohash[1] == gh[1] {
+	ck := -1
+	// Only cities sharing the first two characters can match. Those in the point's bucket share more than that, so the rest are only
+	// looked at when none of them do (they would all tie). Ties are broken by the position of the cities too, so the order they're
+	// scanned in doesn't matter and the result is the same as a full scan.
+	closest, others := g.reverseCandidates(gh)
+	n := 0
+	for b, keys := range append([][]int{closest}, others...) {
+		if b > 0 && ck != -1 {
+			break
+		}
+		for _, k := range keys {
+			if n%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return GeobedCity{}, err
+				}
+			}
+			n++
+			v := g.c[k]
+			if filter != nil && !filter(&g.c[k]) {
+				continue
+			}
 			matched = 2
 			for i := 2; i <= len(gh); i++ {
 				//log.Println(gh[0:i])
@@ -892,9 +2199,10 @@ func (g *GeoBed) ReverseGeocode(lat float64, lng float64) GeobedCity {
 					matched++
 				}
 			}
-			// tie breakers go to city with larger population (NOTE: There's still a chance that the next pass will uncover a better match)
-			if matched == mostMatched && g.c[k].Population > c.Population {
+			// tie breakers go to city with larger population by default (NOTE: There's still a chance that the next pass will uncover a better match)
+			if matched == mostMatched && g.cfg.winsTie(&g.c[k], &c, k, ck) {
 				c = g.c[k]
+				ck = k
 				// log.Println("MATCHES")
 				// log.Println(matched)
 				// log.Println("CITY")
@@ -904,12 +2212,74 @@ func (g *GeoBed) ReverseGeocode(lat float64, lng float64) GeobedCity {
 			}
 			if matched > mostMatched {
 				c = g.c[k]
+				ck = k
 				mostMatched = matched
 			}
 		}
 	}
 
-	return c
+	return c, nil
+}
+
+// Converts a Latin-1 (ISO-8859-1) encoded string to UTF-8. Each byte is the code point of the same value.
+func latin1ToUTF8(s string) string {
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
+
+// Letters that don't decompose into a base letter and a combining mark, with their common ASCII spellings.
+var foldReplacer = strings.NewReplacer("ß", "ss", "ø", "o", "Ø", "O", "ł", "l", "Ł", "L", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE",
+	"đ", "d", "Đ", "D", "ı", "i", "þ", "th", "Þ", "Th")
+
+// Removes diacritics from a string (ie. "Zürich" becomes "Zurich") so names can be matched regardless of accents.
+func foldName(s string) string {
+	if isASCII(s) || !utf8.ValidString(s) {
+		return s
+	}
+	// Swap accented letters for their base letters and drop any combining marks written on their own (ie. "u" followed by U+0308).
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, c := range s {
+		if unicode.Is(unicode.Mn, c) {
+			continue
+		}
+		if f, ok := foldRunes[c]; ok {
+			c = f
+		}
+		b.WriteRune(c)
+	}
+	return foldReplacer.Replace(b.String())
+}
+
+// Lowercases a string with its diacritics removed. This is the form compared against GeobedCity.CityLower.
+func foldLower(s string) string {
+	f := foldName(s)
+	if isASCII(f) {
+		return toLower(f)
+	}
+	// Letters with no plain form (ie. Cyrillic) still need lowercasing, which toLower() leaves alone.
+	return strings.ToLower(f)
+}
+
+// Returns a name from a data set's ASCII name column in the form used for GeobedCity.CityLower. The column isn't always plain ASCII
+// (ie. MaxMind has "querétaro" in Latin-1 here and there), so it's folded the same way as queries are.
+func asciiName(s string) string {
+	if !utf8.ValidString(s) {
+		s = latin1ToUTF8(s)
+	}
+	return foldLower(s)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
 
 // A slightly faster lowercase function.
@@ -939,118 +2309,155 @@ func toUpper(s string) string {
 }
 
 // Dumps the Geobed data to disk. This speeds up startup time on subsequent runs (or if calling NewGeobed() multiple times which should be avoided if possible).
-// TODO: Refactor
+// The data is locked for reading while it's written, so a reload can't swap it out partway through.
 func (g GeoBed) store() error {
-	b := new(bytes.Buffer)
-
-	// Store the city info
-	enc := gob.NewEncoder(b)
-	err := enc.Encode(g.c)
+	defer g.rlock()()
+	var err error
+	if g.cfg.cacheFormat == CacheBinary {
+		err = storeCitiesBinary(g.cfg.dataPath("g.c.bin"), g.c)
+		if err == nil {
+			err = storeCountriesBinary(g.cfg.dataPath("g.co.bin"), g.co)
+		}
+	} else {
+		err = storeGob(g.cfg.dataPath("g.c.dmp"), g.c)
+		if err == nil {
+			err = storeGob(g.cfg.dataPath("g.co.dmp"), g.co)
+		}
+	}
 	if err != nil {
-		b.Reset()
 		return err
 	}
-
-	fh, eopen := os.OpenFile("./geobed-data/g.c.dmp", os.O_CREATE|os.O_WRONLY, 0666)
-	defer fh.Close()
-	if eopen != nil {
-		b.Reset()
-		return eopen
-	}
-	n, e := fh.Write(b.Bytes())
-	if e != nil {
-		b.Reset()
-		return e
+	err = storeGob(g.cfg.dataPath("cityNameIdx.dmp"), g.cityNameIdx)
+	if err != nil {
+		return err
 	}
-	log.Printf("%d bytes successfully written to cache file\n", n)
-
-	// Store the country info as well (this is all now repetition - refactor)
-	b.Reset()
-	//enc = gob.NewEncoder(b)
-	err = enc.Encode(g.co)
+	err = storeGob(g.cfg.dataPath("regionNames.dmp"), g.regionNames)
 	if err != nil {
-		b.Reset()
 		return err
 	}
-
-	fh, eopen = os.OpenFile("./geobed-data/g.co.dmp", os.O_CREATE|os.O_WRONLY, 0666)
-	defer fh.Close()
-	if eopen != nil {
-		b.Reset()
-		return eopen
+	// Only the cities with geohashes are in the index, so it's of no use without them.
+	if g.cfg.fields&FieldGeohash != 0 {
+		err = storeGob(g.cfg.dataPath("spatialIdx.dmp"), g.buckets())
+		if err != nil {
+			return err
+		}
 	}
-	n, e = fh.Write(b.Bytes())
-	if e != nil {
-		b.Reset()
-		return e
+	// Written last, so the cache is only considered complete once everything else was stored.
+	return storeGob(g.cfg.dataPath("meta.dmp"), cacheMeta{Version: cacheVersion, Fields: g.cfg.fields, Format: g.cfg.cacheFormat, SourceDate: g.sourceDate,
+		RegionCrosswalk: g.cfg.regionCrosswalk, Bounds: g.cfg.bounds, MinPopulation: g.cfg.minPopulation, KeepUnknownPopulation: g.cfg.keepUnknownPopulation,
+		Sources: g.cfg.sources, Normalized: g.cfg.normalize != nil})
+}
+
+// Whether two (optional) bounding boxes are the same.
+func sameBounds(a *BoundingBox, b *BoundingBox) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
-	log.Printf("%d bytes successfully written to cache file\n", n)
+	return *a == *b
+}
 
-	// Store the index info (again there's some repetition here)
-	b.Reset()
-	//enc = gob.NewEncoder(b)
-	err = enc.Encode(cityNameIdx)
+// Gob encodes a value and writes it to a cache file.
+func storeGob(path string, v interface{}) error {
+	b := new(bytes.Buffer)
+	enc := gob.NewEncoder(b)
+	err := enc.Encode(v)
 	if err != nil {
-		b.Reset()
 		return err
 	}
 
-	fh, eopen = os.OpenFile("./geobed-data/cityNameIdx.dmp", os.O_CREATE|os.O_WRONLY, 0666)
-	defer fh.Close()
-	if eopen != nil {
-		b.Reset()
-		return eopen
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
 	}
-	n, e = fh.Write(b.Bytes())
-	if e != nil {
-		b.Reset()
-		return e
+	defer fh.Close()
+	n, err := fh.Write(b.Bytes())
+	if err != nil {
+		return err
 	}
 	log.Printf("%d bytes successfully written to cache file\n", n)
-
-	b.Reset()
 	return nil
 }
 
-// Loads a GeobedCity dump, which saves a bit of time.
-func loadGeobedCityData() ([]GeobedCity, error) {
-	fh, err := os.Open("./geobed-data/g.c.dmp")
+// Reads a gob encoded cache file into v.
+func loadGob(fsys fs.FS, name string, v interface{}) error {
+	fh, err := fsys.Open(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	gc := []GeobedCity{}
+	defer fh.Close()
 	dec := gob.NewDecoder(fh)
-	err = dec.Decode(&gc)
+	return dec.Decode(v)
+}
+
+// Loads a GeobedCity dump, which saves a bit of time.
+func loadGeobedCityData(fsys fs.FS, format CacheFormat) ([]GeobedCity, error) {
+	if format == CacheBinary {
+		gc, err := loadCitiesBinary(fsys, "g.c.bin")
+		return gc, cacheErr(err)
+	}
+	gc := []GeobedCity{}
+	err := loadGob(fsys, "g.c.dmp", &gc)
 	if err != nil {
-		return nil, err
+		return nil, cacheErr(err)
 	}
 	return gc, nil
 }
 
-func loadGeobedCountryData() ([]CountryInfo, error) {
-	fh, err := os.Open("./geobed-data/g.co.dmp")
-	if err != nil {
-		return nil, err
+func loadGeobedCountryData(fsys fs.FS, format CacheFormat) ([]CountryInfo, error) {
+	if format == CacheBinary {
+		co, err := loadCountriesBinary(fsys, "g.co.bin")
+		return co, cacheErr(err)
 	}
 	co := []CountryInfo{}
-	dec := gob.NewDecoder(fh)
-	err = dec.Decode(&co)
+	err := loadGob(fsys, "g.co.dmp", &co)
 	if err != nil {
-		return nil, err
+		return nil, cacheErr(err)
 	}
 	return co, nil
 }
 
-func loadGeobedCityNameIdx() error {
-	fh, err := os.Open("./geobed-data/cityNameIdx.dmp")
-	if err != nil {
-		return err
+func loadGeobedCityNameIdx(fsys fs.FS) (map[string]int, error) {
+	idx := make(map[string]int)
+	return idx, cacheErr(loadGob(fsys, "cityNameIdx.dmp", &idx))
+}
+
+func loadGeobedRegionNames(fsys fs.FS) (map[string]string, error) {
+	names := make(map[string]string)
+	return names, cacheErr(loadGob(fsys, "regionNames.dmp", &names))
+}
+
+// Loads the description of how the cached data was built.
+func loadGeobedCacheMeta(fsys fs.FS) (cacheMeta, error) {
+	meta := cacheMeta{}
+	err := loadGob(fsys, "meta.dmp", &meta)
+	return meta, cacheErr(err)
+}
+
+// Removes the cached data dumps from the given data directory so the next call to NewGeobed() rebuilds them from the source data sets.
+// An empty dataDir means the same directory NewGeobed() uses by default ($GEOBED_DATA_DIR or "./geobed-data").
+func PurgeCache(dataDir string) error {
+	return purgeFiles(dataDir, cacheFiles)
+}
+
+// Removes the downloaded data set files along with the cache, so the next call to NewGeobed() downloads them again. An empty dataDir
+// means the default directory, as with PurgeCache().
+func PurgeDataSets(dataDir string) error {
+	files := append([]string{}, cacheFiles...)
+	for _, f := range dataSetFiles {
+		files = append(files, filepath.Base(f["path"]))
 	}
-	dec := gob.NewDecoder(fh)
-	cityNameIdx = make(map[string]int)
-	err = dec.Decode(&cityNameIdx)
-	if err != nil {
-		return err
+	return purgeFiles(dataDir, files)
+}
+
+func purgeFiles(dataDir string, files []string) error {
+	if dataDir == "" {
+		dataDir = defaultDataDir()
+	}
+	for _, f := range files {
+		err := os.Remove(filepath.Join(dataDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
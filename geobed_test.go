@@ -1,8 +1,27 @@
 package geobed
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -18,23 +37,42 @@ var g GeoBed
 
 func (s *GeobedSuite) SetUpSuite(c *C) {
 	// This is a common alternate name. However, there's a city called "Apple" (at least one). So it's a bit difficult.
-	// Plus many people would put "The Big Apple" ... Yet Geonames alt city names has just "Big Apple" ... It may be worth trying to improve this though.
-	//s.testLocations = append(s.testLocations, map[string]string{"query": "Big Apple", "city": "New York City", "country": "US", "region": "NY"})
+	// Plus many people would put "The Big Apple" ... Yet Geonames alt city names has just "Big Apple" ... Matching the whole alternate name handles it.
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Big Apple", "city": "New York City", "country": "US", "region": "NY"})
 
-	//s.testLocations = append(s.testLocations, map[string]string{"query": "NYC", "city": "New York City", "country": "US", "region": "NY"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "NYC", "city": "New York City", "country": "US", "region": "NY"})
 
 	s.testLocations = append(s.testLocations, map[string]string{"query": "New York, NY", "city": "New York", "country": "US", "region": "NY"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "New York", "city": "New York City", "country": "US", "region": "NY"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "new york", "city": "New York City", "country": "US", "region": "NY"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "Austin Tx", "city": "Austin", "country": "US", "region": "TX"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "tx austin", "city": "Austin", "country": "US", "region": "TX"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "Paris, TX", "city": "Paris", "country": "US", "region": "TX"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "New Paris, IN", "city": "New Paris", "country": "US", "region": "IN"})
-	//s.testLocations = append(s.testLocations, map[string]string{"query": "Sweden, Stockholm", "city": "Stockholm Center", "country": "SE", "region": "26"})
-	//s.testLocations = append(s.testLocations, map[string]string{"query": "Stockholm", "city": "Stockholm", "country": "SE", "region": "26"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Sweden, Stockholm", "city": "Stockholm", "country": "SE", "region": "26"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Stockholm", "city": "Stockholm", "country": "SE", "region": "26"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "Newport Beach, Orange County ", "city": "Newport Beach", "country": "US", "region": "CA"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "Newport Beach", "city": "Newport Beach", "country": "US", "region": "CA"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "North Las Vegas", "city": "North Las Vegas", "country": "US", "region": "NV"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "West Palm Beach", "city": "West Palm Beach", "country": "US", "region": "FL"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "N. Las Vegas, NV", "city": "North Las Vegas", "country": "US", "region": "NV"})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "london", "city": "London", "country": "GB", "region": ""})
 	s.testLocations = append(s.testLocations, map[string]string{"query": "Paris", "city": "Paris", "country": "FR", "region": "A8"})
+	// Matches on the plain ASCII name, but displays the accented one.
+	s.testLocations = append(s.testLocations, map[string]string{"query": "sao paulo", "city": "São Paulo", "country": "BR", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "São Paulo", "city": "São Paulo", "country": "BR", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "near Boston", "city": "Boston", "country": "US", "region": "MA"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "greater London", "city": "London", "country": "GB", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "downtown Chicago, IL", "city": "Chicago", "country": "US", "region": "IL"})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Greater Sudbury", "city": "Greater Sudbury", "country": "CA", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Zurich", "city": "Zürich", "country": "CH", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Zürich", "city": "Zürich", "country": "CH", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Dusseldorf", "city": "Düsseldorf", "country": "DE", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Düsseldorf", "city": "Düsseldorf", "country": "DE", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Malmo", "city": "Malmö", "country": "SE", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Montreal", "city": "Montréal", "country": "CA", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "MÉRIDA", "city": "Mérida", "country": "MX", "region": ""})
+	s.testLocations = append(s.testLocations, map[string]string{"query": "Merida, Mexico", "city": "Mérida", "country": "MX", "region": ""})
 	//s.testLocations = append(s.testLocations, map[string]string{"query": "New Paris", "city": "New Paris", "country": "US", "region": "IN"})
 
 	// Often, "AUS" ends up mapping to Austria.
@@ -43,18 +81,20 @@ func (s *GeobedSuite) SetUpSuite(c *C) {
 	//s.testLocations = append(s.testLocations, map[string]string{"query": "SFO", "city": "San Francisco", "country": "US", "region": "CA"})
 	//s.testLocations = append(s.testLocations, map[string]string{"query": "AUS", "city": "Austin", "country": "US", "region": "TX"})
 
-	// Will test out of range on the slice when looking up (0 end)
-	s.testLocations = append(s.testLocations, map[string]string{"query": "ਪੈਰਿਸ", "city": "'Aade\xefssa", "country": "SY", "region": "03"})
+	// Will test out of range on the slice when looking up (0 end). It's also an alternate name for Paris.
+	s.testLocations = append(s.testLocations, map[string]string{"query": "ਪੈਰਿਸ", "city": "Paris", "country": "FR", "region": "A8"})
 }
 
 func (s *GeobedSuite) TestANewGeobed(c *C) {
-	g = NewGeobed()
+	var err error
+	g, err = NewGeobed()
+	c.Assert(err, IsNil)
 	c.Assert(len(g.c), Not(Equals), 0)
 	c.Assert(len(g.co), Not(Equals), 0)
-	c.Assert(len(cityNameIdx), Not(Equals), 0)
+	c.Assert(len(g.cityNameIdx), Not(Equals), 0)
 	c.Assert(g.c, FitsTypeOf, []GeobedCity(nil))
 	c.Assert(g.co, FitsTypeOf, []CountryInfo(nil))
-	c.Assert(cityNameIdx, FitsTypeOf, make(map[string]int))
+	c.Assert(g.cityNameIdx, FitsTypeOf, make(map[string]int))
 }
 
 func (s *GeobedSuite) TestGeocode(c *C) {
@@ -70,7 +110,14 @@ func (s *GeobedSuite) TestGeocode(c *C) {
 		}
 	}
 
-	r := g.Geocode("")
+	r := g.Geocode("Paris")
+	c.Assert(r.MatchedAlias, Equals, "")
+	r = g.Geocode("ਪੈਰਿਸ")
+	c.Assert(r.MatchedAlias, Equals, "ਪੈਰਿਸ")
+	r = g.Geocode("nyc")
+	c.Assert(r.MatchedAlias, Equals, "NYC")
+
+	r = g.Geocode("")
 	c.Assert(r.City, Equals, "")
 
 	r = g.Geocode(" ")
@@ -100,11 +147,1025 @@ func (s *GeobedSuite) TestReverseGeocode(c *C) {
 	c.Assert(r.City, Equals, "City of London")
 }
 
+func (s *GeobedSuite) TestNearNullIsland(c *C) {
+	// São Tomé is in the Gulf of Guinea, not far from 0, 0.
+	r := g.ReverseGeocode(0.34, 6.73)
+	c.Assert(r.Country, Equals, "ST")
+	c.Assert(r.Geohash, Not(Equals), "")
+	c.Assert(g.ReverseGeocode(0, 0).City, Equals, "")
+
+	c.Assert(cityGeohash(0, 0), Equals, "")
+	c.Assert(cityGeohash(91, 0), Equals, "")
+	// Right next to 0, 0 (the geohash the empty coordinates used to be caught by).
+	c.Assert(cityGeohash(-0.000000001, -0.000000001), Equals, "7zzzzzzzzzzz")
+
+	row := func(name, lat, lng string) string {
+		return strings.Join([]string{"1", name, name, "", lat, lng, "P", "PPL", "ST", "", "01", "", "", "", "100", "", "", "Africa/Sao_Tome", "2015-09-01"}, "\t") + "\n"
+	}
+	mg := GeoBed{cfg: newConfig(nil)}
+	mg.loadGeonamesCities(strings.NewReader(row("Nowhere", "", "") + row("Almost Nowhere", "-0.000000001", "-0.000000001")))
+	gh := map[string]string{}
+	for _, v := range mg.c {
+		gh[v.City] = v.Geohash
+	}
+	c.Assert(gh["Nowhere"], Equals, "")
+	c.Assert(gh["Almost Nowhere"], Equals, "7zzzzzzzzzzz")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeRounded(c *C) {
+	r := g.ReverseGeocodeRounded(30.26715, -97.74306, 6)
+	c.Assert(r.City, Equals, "Austin")
+
+	// Points in the same cell get the same city.
+	gh := EncodeGeohash(37.44, -122.15)[:3]
+	c.Assert(EncodeGeohash(37.44651, -122.15322)[:3], Equals, gh)
+	lat, lng := DecodeGeohash(gh)
+	c.Assert(g.ReverseGeocodeRounded(37.44, -122.15, 3), DeepEquals, g.ReverseGeocode(lat, lng))
+	c.Assert(g.ReverseGeocodeRounded(37.44651, -122.15322, 3), DeepEquals, g.ReverseGeocodeRounded(37.44, -122.15, 3))
+
+	c.Assert(g.ReverseGeocodeRounded(91, 0, 6).City, Equals, "")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeContext(c *C) {
+	r, err := g.ReverseGeocodeContext(context.Background(), 30.26715, -97.74306)
+	c.Assert(err, IsNil)
+	c.Assert(r.City, Equals, "Austin")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err = g.ReverseGeocodeContext(ctx, 30.26715, -97.74306)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(r.City, Equals, "")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeInCountry(c *C) {
+	r := g.ReverseGeocodeInCountry(30.26715, -97.74306, "US")
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(r.Country, Equals, "US")
+
+	r = g.ReverseGeocodeInCountry(30.26715, -97.74306, "us")
+	c.Assert(r.City, Equals, "Austin")
+
+	// Nowhere near France.
+	r = g.ReverseGeocodeInCountry(30.26715, -97.74306, "FR")
+	c.Assert(r.City, Equals, "")
+}
+
+func (s *GeobedSuite) TestWarmSpatialIndex(c *C) {
+	g.WarmSpatialIndex()
+	c.Assert(g.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+
+	// Without an index (not made by NewGeobed) the buckets are built on each call.
+	mg := GeoBed{c: g.c, cfg: g.cfg}
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeIndex(c *C) {
+	// The same city a scan over all of them finds, the one sharing the most of its geohash with the point.
+	fullScan := func(lat float64, lng float64) GeobedCity {
+		gh := EncodeGeohash(lat, lng)
+		best := GeobedCity{}
+		bk, most := -1, 0
+		for k, v := range g.c {
+			if len(v.Geohash) < reversePrefixLen || v.Geohash[:reversePrefixLen] != gh[:reversePrefixLen] {
+				continue
+			}
+			matched := reversePrefixLen
+			for matched < len(gh) && v.Geohash[matched] == gh[matched] {
+				matched++
+			}
+			if matched > most || (matched == most && g.cfg.winsTie(&g.c[k], &best, k, bk)) {
+				best, bk, most = v, k, matched
+			}
+		}
+		return best
+	}
+	points := [][2]float64{{30.26715, -97.74306}, {51.51279, -0.09184}, {37.44651, -122.15322}, {48.9, 2.4}, {-33.9, 151.2}, {35.7, 139.7}, {0.3, 6.7}, {61.5, -149.9}}
+	for _, p := range points {
+		c.Assert(g.ReverseGeocode(p[0], p[1]).City, Equals, fullScan(p[0], p[1]).City, Commentf("%v", p))
+	}
+
+	// The index is stored with the cache and read back instead of being built.
+	dir := c.MkDir()
+	path := filepath.Join(dir, "spatialIdx.dmp")
+	c.Assert(storeGob(path, g.buckets()), IsNil)
+	idx, err := loadGeobedSpatialIdx(os.DirFS(dir), "spatialIdx.dmp")
+	c.Assert(err, IsNil)
+	c.Assert(idx, DeepEquals, g.buckets())
+	mg := GeoBed{c: g.c, cfg: g.cfg, spatial: &spatialIndex{fsys: os.DirFS(dir)}}
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+
+	// One from a different version gets rebuilt.
+	c.Assert(storeGob(path, map[string][]int{"9v": {0}}), IsNil)
+	_, err = loadGeobedSpatialIdx(os.DirFS(dir), "spatialIdx.dmp")
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, true)
+	mg = GeoBed{c: g.c, cfg: g.cfg, spatial: &spatialIndex{fsys: os.DirFS(dir)}}
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeN(c *C) {
+	cities := g.ReverseGeocodeN(30.26715, -97.74306, 3)
+	c.Assert(len(cities) > 1 && len(cities) <= 3, Equals, true)
+	c.Assert(cities[0].City, Equals, "Austin")
+	for k := 1; k < len(cities); k++ {
+		c.Assert(Distance(30.26715, -97.74306, cities[k].Latitude, cities[k].Longitude) >=
+			Distance(30.26715, -97.74306, cities[k-1].Latitude, cities[k-1].Longitude), Equals, true)
+	}
+	// The nearest is across the antimeridian, on Taveuni.
+	cities = g.ReverseGeocodeN(-16.85, 179.99, 1)
+	c.Assert(cities, HasLen, 1)
+	c.Assert(cities[0].Longitude < 0, Equals, true)
+
+	// Far out in the Pacific there's nothing nearby, and nothing made up to fill in.
+	c.Assert(g.ReverseGeocodeN(-48.87, -123.39, 5), HasLen, 0)
+	c.Assert(g.ReverseGeocodeN(30.26715, -97.74306, 0), HasLen, 0)
+	c.Assert(g.ReverseGeocodeN(91, -97.74306, 3), HasLen, 0)
+}
+
+func (s *GeobedSuite) TestCitiesWithinRadius(c *C) {
+	cities := g.CitiesWithinRadius(30.26715, -97.74306, 300, 0)
+	c.Assert(len(cities) > 1, Equals, true)
+	c.Assert(cities[0].City, Equals, "Austin")
+	found := false
+	for k, v := range cities {
+		d := Distance(30.26715, -97.74306, v.Latitude, v.Longitude)
+		c.Assert(d <= 300, Equals, true)
+		if k > 0 {
+			c.Assert(d >= Distance(30.26715, -97.74306, cities[k-1].Latitude, cities[k-1].Longitude), Equals, true)
+		}
+		found = found || v.City == "Houston"
+	}
+	c.Assert(found, Equals, true)
+
+	// Fiji's cities are on both sides of the antimeridian.
+	cities = g.CitiesWithinRadius(-16.6, 179.9, 150, 0)
+	east, west := false, false
+	for _, v := range cities {
+		c.Assert(Distance(-16.6, 179.9, v.Latitude, v.Longitude) <= 150, Equals, true)
+		east = east || v.Longitude < 0
+		west = west || v.Longitude > 0
+	}
+	c.Assert(east && west, Equals, true)
+
+	// Everything within a radius that takes in the pole, without any degree based box to break.
+	for _, v := range g.CitiesWithinRadius(89.9, 0, 3000, 0) {
+		c.Assert(v.Latitude > 60, Equals, true)
+	}
+	c.Assert(g.CitiesWithinRadius(30.26715, -97.74306, -1, 0), HasLen, 0)
+	c.Assert(g.CitiesWithinRadius(91, -97.74306, 10, 0), HasLen, 0)
+
+	// With a limit, the most populous cities in the radius.
+	all := g.CitiesWithinRadius(30.26715, -97.74306, 300, 0)
+	largest := g.CitiesWithinRadius(30.26715, -97.74306, 300, 2)
+	c.Assert(largest, HasLen, 2)
+	c.Assert(populations(largest), DeepEquals, populations(largestCities(all, 2)))
+	c.Assert(largest[0].City, Equals, "Houston")
+	c.Assert(g.CitiesWithinRadius(30.26715, -97.74306, 300, len(all)+10), HasLen, len(all))
+}
+
+// Returns the populations of the cities, in order.
+func populations(cities []GeobedCity) []int32 {
+	p := []int32{}
+	for _, v := range cities {
+		p = append(p, v.Population)
+	}
+	return p
+}
+
+func (s *GeobedSuite) TestCitiesInBounds(c *C) {
+	// Around Texas.
+	cities := g.CitiesInBounds(25.8, -106.7, 36.5, -93.5, 0)
+	names := map[string]bool{}
+	for _, v := range cities {
+		c.Assert(v.Latitude >= 25.8 && v.Latitude <= 36.5 && v.Longitude >= -106.7 && v.Longitude <= -93.5, Equals, true)
+		names[v.City] = true
+	}
+	c.Assert(names["Austin"] && names["Houston"], Equals, true)
+	c.Assert(names["Boston"], Equals, false)
+
+	// Fiji, across the antimeridian, with cities on both sides and none twice.
+	cities = g.CitiesInBounds(-21, 176, -12, -178, 0)
+	east, west := false, false
+	seen := map[GeobedCity]bool{}
+	for _, v := range cities {
+		c.Assert(v.Latitude >= -21 && v.Latitude <= -12 && (v.Longitude >= 176 || v.Longitude <= -178), Equals, true)
+		c.Assert(seen[v], Equals, false)
+		seen[v] = true
+		east = east || v.Longitude < 0
+		west = west || v.Longitude > 0
+	}
+	c.Assert(east && west, Equals, true)
+
+	c.Assert(g.CitiesInBounds(36.5, -106.7, 25.8, -93.5, 0), HasLen, 0)
+	c.Assert(g.CitiesInBounds(25.8, -181, 36.5, -93.5, 0), HasLen, 0)
+
+	// The biggest cities in the box, largest first.
+	all := g.CitiesInBounds(25.8, -106.7, 36.5, -93.5, 0)
+	largest := g.CitiesInBounds(25.8, -106.7, 36.5, -93.5, 3)
+	c.Assert(largest, HasLen, 3)
+	c.Assert(populations(largest), DeepEquals, populations(largestCities(all, 3)))
+	for _, v := range all {
+		c.Assert(v.Population <= largest[0].Population, Equals, true)
+	}
+	c.Assert(largest[0].City, Equals, "Houston")
+}
+
+func (s *GeobedSuite) TestReverseGeocodeByFeature(c *C) {
+	// Houston, the nearest state capital is Austin.
+	r, ok := g.ReverseGeocodeByFeature(29.76328, -95.36327, []string{"PPLA"})
+	c.Assert(ok, Equals, true)
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(r.FeatureCode, Equals, "PPLA")
+
+	r, ok = g.ReverseGeocodeByFeature(49.5, 3.1, []string{"pplc", "PPLA"})
+	c.Assert(ok, Equals, true)
+	c.Assert(r.City, Equals, "Paris")
+
+	_, ok = g.ReverseGeocodeByFeature(49.5, 3.1, []string{"NOPE"})
+	c.Assert(ok, Equals, false)
+	_, ok = g.ReverseGeocodeByFeature(91, 3.1, []string{"PPLC"})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestGeocodeWithDistance(c *C) {
+	r, d := g.GeocodeWithDistance("Austin, TX", 29.76328, -95.36327)
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(d > 230 && d < 240, Equals, true)
+
+	_, d = g.GeocodeWithDistance("", 29.76328, -95.36327)
+	c.Assert(d, Equals, float64(-1))
+}
+
+func (s *GeobedSuite) TestDistance(c *C) {
+	pairs := []struct {
+		name         string
+		lat1, lng1   float64
+		lat2, lng2   float64
+		minKm, maxKm float64
+	}{
+		{"Austin to Houston", 30.26715, -97.74306, 29.76328, -95.36327, 230, 240},
+		{"London to Paris", 51.50853, -0.12574, 48.85341, 2.3488, 340, 350},
+		{"New York to Los Angeles", 40.71427, -74.00597, 34.05223, -118.24368, 3930, 3950},
+		{"Across the antimeridian", 0, 179.5, 0, -179.5, 110, 112},
+		{"The same place", 30.26715, -97.74306, 30.26715, -97.74306, 0, 0},
+	}
+	for _, p := range pairs {
+		d := Distance(p.lat1, p.lng1, p.lat2, p.lng2)
+		c.Check(d >= p.minKm && d <= p.maxKm, Equals, true, Commentf("%s: %f", p.name, d))
+		// Either way around.
+		c.Check(math.Abs(Distance(p.lat2, p.lng2, p.lat1, p.lng1)-d) < 1e-9, Equals, true, Commentf(p.name))
+	}
+}
+
+func (s *GeobedSuite) TestReverseGeocodeWithDistance(c *C) {
+	r, d := g.ReverseGeocodeWithDistance(30.27, -97.74)
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(d > 0 && d < 1, Equals, true)
+
+	_, d = g.ReverseGeocodeWithDistance(91, -97.74)
+	c.Assert(d, Equals, float64(-1))
+}
+
 func (s *GeobedSuite) TestNext(c *C) {
 	c.Assert(string(prev(rune("new york"[0]))), Equals, "m")
 	c.Assert(prev(rune("new york"[0])), Equals, int32(109))
 }
 
+// Uses a handful of cities (sorted by name) and their name index for the search.
+func testCities(cities Cities, idx map[string]int) GeoBed {
+	return GeoBed{c: cities, cityNameIdx: idx}
+}
+
+func (s *GeobedSuite) TestFuzzyMatchScoreKeys(c *C) {
+	tg := testCities(Cities{{City: "Austin", Country: "US", Region: "TX"}, {City: "Boston", Country: "US", Region: "MA"}}, map[string]int{"a": 0, "b": 1})
+	// The score belongs to Austin, not the city after it.
+	c.Assert(tg.fuzzyMatchLocation("Austin", GeocodeOptions{}).City, Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestGetSearchRange(c *C) {
+	tg := testCities(Cities{{City: "Albany"}, {City: "Austin"}, {City: "Boston"}}, map[string]int{"a": 1, "b": 2})
+	// The last city starting with the letter is in the range.
+	c.Assert(tg.getSearchRange([]string{"Austin"}), DeepEquals, []r{{0, 2}})
+	// So is the last city of them all when the letter isn't indexed.
+	c.Assert(tg.getSearchRange([]string{"Zurich"}), DeepEquals, []r{{0, 3}})
+}
+
+func (s *GeobedSuite) TestFuzzyMatchCityAndState(c *C) {
+	tg := testCities(Cities{{City: "Austin", Country: "US", Region: "TX"}, {City: "Austin Lake", Country: "US", Region: "TX", Population: 5000}},
+		map[string]int{"a": 1})
+	// The exact city and state win over a bigger city that only contains the name.
+	c.Assert(tg.fuzzyMatchLocation("Austin, TX", GeocodeOptions{}).City, Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestFuzzyMatchAltNames(c *C) {
+	tg := testCities(Cities{{City: "Apple Valley", Country: "US", Region: "CA", Population: 70000}, {City: "New York City", CityAlt: "Big Apple,NYC", Country: "US", Region: "NY"}},
+		map[string]int{"a": 0, "n": 1})
+	// Alternate names can be more than one word.
+	c.Assert(tg.fuzzyMatchLocation("Big Apple", GeocodeOptions{}).City, Equals, "New York City")
+}
+
+func (s *GeobedSuite) TestDirectionalCityName(c *C) {
+	n, ok := directionalCityName([]string{"N.", "Las", "Vegas,"})
+	c.Assert(ok, Equals, true)
+	c.Assert(n, Equals, "North Las Vegas")
+
+	n, ok = directionalCityName([]string{"west", "Palm", "Beach"})
+	c.Assert(ok, Equals, true)
+	c.Assert(n, Equals, "West Palm Beach")
+
+	_, ok = directionalCityName([]string{"North"})
+	c.Assert(ok, Equals, false)
+	_, ok = directionalCityName([]string{"Las", "Vegas"})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestLatin1ToUTF8(c *C) {
+	c.Assert(latin1ToUTF8("S\xe3o Paulo"), Equals, "São Paulo")
+	c.Assert(latin1ToUTF8("Austin"), Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestCitiesByName(c *C) {
+	cities := g.CitiesByName("springfield")
+	c.Assert(len(cities) >= 3, Equals, true)
+	for i, v := range cities {
+		c.Assert(v.City, Equals, "Springfield")
+		if i > 0 {
+			c.Assert(v.Population <= cities[i-1].Population, Equals, true)
+		}
+	}
+
+	cities = g.CitiesByName("Paris")
+	c.Assert(len(cities) >= 2, Equals, true)
+	c.Assert(cities[0].Country, Equals, "FR")
+
+	c.Assert(g.CitiesByName("Zurich")[0].City, Equals, "Zürich")
+	c.Assert(len(g.CitiesByName("")), Equals, 0)
+}
+
+func (s *GeobedSuite) TestTieBreak(c *C) {
+	small := GeobedCity{City: "Austin", CityLower: "austin", Country: "US", Region: "MN", Population: 24718}
+	big := GeobedCity{City: "Austin", CityLower: "austin", Country: "US", Region: "TX", Population: 931830}
+	c.Assert(config{tieBreak: TieBreakPopulation}.winsTie(&big, &small, 1, 0), Equals, true)
+	c.Assert(config{tieBreak: TieBreakAlphabetical}.winsTie(&small, &big, 1, 0), Equals, true)
+	c.Assert(config{tieBreak: TieBreakSourcePriority}.winsTie(&small, &big, 1, 0), Equals, false)
+	c.Assert(config{tieBreak: TieBreakSourcePriority}.winsTie(&small, &big, 0, 1), Equals, true)
+}
+
+func (s *GeobedSuite) TestGeohash(c *C) {
+	gh := EncodeGeohash(30.26715, -97.74306)
+	c.Assert(len(gh), Equals, 12)
+	lat, lng := DecodeGeohash(gh)
+	c.Assert(Distance(lat, lng, 30.26715, -97.74306) < 0.001, Equals, true)
+	lat, lng = DecodeGeohash("not a geohash")
+	c.Assert(lat == 0 && lng == 0, Equals, true)
+
+	// A precision 5 cell is 180/2^12 degrees tall and 360/2^13 degrees wide.
+	hash := gh[:5]
+	lat, lng = DecodeGeohash(hash)
+	dLat, dLng := 180.0/4096, 360.0/8192
+	expected := [][2]float64{{dLat, 0}, {dLat, dLng}, {0, dLng}, {-dLat, dLng}, {-dLat, 0}, {-dLat, -dLng}, {0, -dLng}, {dLat, -dLng}}
+	neighbors := GeohashNeighbors(hash)
+	c.Assert(len(neighbors), Equals, 8)
+	for i, n := range neighbors {
+		c.Assert(n, Equals, EncodeGeohash(lat+expected[i][0], lng+expected[i][1])[:5])
+	}
+	c.Assert(GeohashNeighbors(""), IsNil)
+}
+
+func (s *GeobedSuite) TestGeohashCellsForRadius(c *C) {
+	// Every city within the radius is in one of the cells.
+	for _, radius := range []float64{0.5, 10, 150, 2000, 8000} {
+		for _, p := range [][2]float64{{30.26715, -97.74306}, {37.44, -122.15}, {-17, 179.9}, {59.3, 18.06}} {
+			cells := GeohashCellsForRadius(p[0], p[1], radius)
+			c.Assert(len(cells) > 0, Equals, true)
+			for _, v := range g.c {
+				if v.Geohash == "" || Distance(p[0], p[1], v.Latitude, v.Longitude) > radius {
+					continue
+				}
+				found := false
+				for _, cell := range cells {
+					found = found || strings.HasPrefix(v.Geohash, cell)
+				}
+				c.Assert(found, Equals, true, Commentf("%s within %vkm of %v", v.City, radius, p))
+			}
+		}
+	}
+
+	c.Assert(GeohashCellsForRadius(30.26715, -97.74306, 10), HasLen, 9)
+	c.Assert(GeohashCellsForRadius(30.26715, -97.74306, 20000), HasLen, 32)
+	c.Assert(GeohashCellsForRadius(91, 0, 10), IsNil)
+}
+
+func (s *GeobedSuite) TestGeocodeBatch(c *C) {
+	queries := []string{"Austin, TX", "Paris", "", "NYC"}
+	results := g.GeocodeBatch(queries, 2)
+	c.Assert(len(results), Equals, len(queries))
+	for i, q := range queries {
+		c.Assert(results[i], Equals, g.Geocode(q))
+	}
+	c.Assert(len(g.GeocodeBatch(nil, 0)), Equals, 0)
+
+	gn := g
+	gn.cfg.workers = 3
+	c.Assert(gn.GeocodeBatch(queries, 0), DeepEquals, results)
+
+	// Many more queries than workers still come back in order.
+	many := []string{}
+	for i := 0; i < 50; i++ {
+		many = append(many, queries...)
+	}
+	for i, r := range g.GeocodeBatch(many, 7) {
+		c.Assert(r, Equals, results[i%len(queries)])
+	}
+}
+
+func (s *GeobedSuite) TestReverseGeocodeBatch(c *C) {
+	coords := [][2]float64{{30.26715, -97.74306}, {37.44651, -122.15322}, {91, 0}, {51.51279, -0.09184}}
+	results := g.ReverseGeocodeBatch(coords, 0)
+	c.Assert(len(results), Equals, len(coords))
+	for i, p := range coords {
+		c.Assert(results[i], Equals, g.ReverseGeocode(p[0], p[1]))
+	}
+	c.Assert(results[0].City, Equals, "Austin")
+	c.Assert(results[2].City, Equals, "")
+}
+
+func (s *GeobedSuite) TestGeocodeFileResumable(c *C) {
+	dir := c.MkDir()
+	inPath := filepath.Join(dir, "in.txt")
+	outPath := filepath.Join(dir, "out.csv")
+	c.Assert(ioutil.WriteFile(inPath, []byte("Austin, TX\nParis\nNYC\n"), 0666), IsNil)
+
+	c.Assert(g.GeocodeFileResumable(inPath, outPath), IsNil)
+	full, err := ioutil.ReadFile(outPath)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSuffix(string(full), "\n"), "\n")
+	c.Assert(len(lines), Equals, 3)
+	c.Assert(strings.HasPrefix(lines[0], `"Austin, TX",Austin,TX,US,`), Equals, true)
+
+	// Interrupted after the first line and part of the second. The first line shouldn't be geocoded again.
+	partial := lines[0] + "\n" + lines[1][:3]
+	partial = strings.Replace(partial, "Austin,TX", "Marker,TX", 1)
+	c.Assert(ioutil.WriteFile(outPath, []byte(partial), 0666), IsNil)
+	c.Assert(g.GeocodeFileResumable(inPath, outPath), IsNil)
+	resumed, err := ioutil.ReadFile(outPath)
+	c.Assert(err, IsNil)
+	c.Assert(string(resumed), Equals, strings.Replace(string(full), "Austin,TX", "Marker,TX", 1))
+
+	// Nothing left to do.
+	c.Assert(g.GeocodeFileResumable(inPath, outPath), IsNil)
+	again, err := ioutil.ReadFile(outPath)
+	c.Assert(err, IsNil)
+	c.Assert(string(again), Equals, string(resumed))
+}
+
+func (s *GeobedSuite) TestQualifiers(c *C) {
+	n, q := stripQualifiers("Near Boston")
+	c.Assert(n, Equals, "Boston")
+	c.Assert(q, Equals, "near")
+	n, q = stripQualifiers("Austin, TX")
+	c.Assert(n, Equals, "Austin, TX")
+	c.Assert(q, Equals, "")
+	n, q = stripQualifiers("metro")
+	c.Assert(n, Equals, "metro")
+	c.Assert(q, Equals, "")
+
+	c.Assert(g.Geocode("outside Chicago").Qualifier, Equals, "outside")
+	c.Assert(g.Geocode("Chicago").Qualifier, Equals, "")
+	c.Assert(g.Geocode("Greater Sudbury").Qualifier, Equals, "")
+}
+
+func (s *GeobedSuite) TestRepeatedWords(c *C) {
+	r := g.Geocode("New York New York")
+	c.Assert(r.City, Equals, "New York City")
+	r = g.Geocode("London London")
+	c.Assert(r.City, Equals, "London")
+
+	// Repeating the words adds nothing to the scores.
+	k := 0
+	for k = range g.c {
+		if g.c[k].City == "New York City" {
+			break
+		}
+	}
+	c.Assert(g.scoreLocation("New York New York", GeocodeOptions{}, true).scores[k], Equals, g.scoreLocation("New York York", GeocodeOptions{}, true).scores[k])
+}
+
+func (s *GeobedSuite) TestStateCodeIsNotCountryCode(c *C) {
+	k := 0
+	for k = range g.c {
+		if g.c[k].City == "New Delhi" && g.c[k].Country == "IN" {
+			break
+		}
+	}
+	// "IN" is Indiana here, so it shouldn't add anything for cities in India.
+	c.Assert(g.scoreLocation("IN New Paris", GeocodeOptions{}, true).scores[k], Equals, g.scoreLocation("New Paris", GeocodeOptions{}, true).scores[k])
+
+	loc := g.Geocode("IN New Paris")
+	c.Assert(loc.City, Equals, "New Paris")
+	c.Assert(loc.Country, Equals, "US")
+}
+
+func (s *GeobedSuite) TestStopwords(c *C) {
+	r := g.Geocode("based out of Austin TX")
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(r.Region, Equals, "TX")
+	r = g.Geocode("living in London")
+	c.Assert(r.City, Equals, "London")
+	c.Assert(r.Country, Equals, "GB")
+	r = g.Geocode("Currently in: Paris, France")
+	c.Assert(r.City, Equals, "Paris")
+	c.Assert(r.Country, Equals, "FR")
+
+	c.Assert(g.withoutStopwords("from"), Equals, "from")
+
+	gn := g
+	gn.cfg.stopwords = newConfig([]Option{WithStopwords(append(DefaultStopwords, "hometown:"))}).stopwords
+	c.Assert(gn.withoutStopwords("Hometown: Austin, TX"), Equals, "Austin, TX")
+	gn.cfg.stopwords = newConfig([]Option{WithStopwords(nil)}).stopwords
+	c.Assert(gn.withoutStopwords("living in London"), Equals, "living in London")
+}
+
+func (s *GeobedSuite) TestLargestCities(c *C) {
+	cities := []GeobedCity{{City: "a", Population: 10}, {City: "b", Population: 30}, {City: "c", Population: 20}}
+	top := largestCities(cities, 2)
+	c.Assert(len(top), Equals, 2)
+	c.Assert(top[0].City, Equals, "b")
+	c.Assert(top[1].City, Equals, "c")
+	c.Assert(len(largestCities(cities, 0)), Equals, 3)
+}
+
+func (s *GeobedSuite) TestCountryBounds(c *C) {
+	minLat, minLng, maxLat, maxLng, ok := g.CountryBounds("us")
+	c.Assert(ok, Equals, true)
+	c.Assert(minLat < 30.26715 && maxLat > 30.26715, Equals, true)
+	c.Assert(minLng < -97.74306 && maxLng > -97.74306, Equals, true)
+
+	// Fiji crosses the antimeridian.
+	_, minLng, _, maxLng, ok = g.CountryBounds("FJ")
+	c.Assert(ok, Equals, true)
+	c.Assert(minLng > maxLng, Equals, true)
+
+	_, _, _, _, ok = g.CountryBounds("XX")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestReverseGeocodeCountry(c *C) {
+	co, ok := g.ReverseGeocodeCountry(30.26715, -97.74306)
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "US")
+
+	// Without geohashes no city is found, so the fallbacks are used.
+	gn := g
+	gn.cfg.fields = FieldCityAlt | FieldPopulation
+	co, ok = gn.ReverseGeocodeCountry(-16.5, 179.99)
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "FJ")
+	// Off the coast of Ghana, closest to Accra.
+	co, ok = gn.ReverseGeocodeCountry(4.0, -1.0)
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "GH")
+}
+
+func (s *GeobedSuite) TestCentralCity(c *C) {
+	r, ok := g.CentralCity("us")
+	c.Assert(ok, Equals, true)
+	c.Assert(r.City, Equals, "Springfield")
+	c.Assert(r.Region, Equals, "MO")
+
+	// Fiji crosses the antimeridian, averaging the longitudes would put the center on the other side of the world.
+	r, ok = g.CentralCity("FJ")
+	c.Assert(ok, Equals, true)
+	c.Assert(r.Country, Equals, "FJ")
+	lat, lng, ok := centroid([]float64{-18, -16}, []float64{179, -179})
+	c.Assert(ok, Equals, true)
+	c.Assert(math.Abs(lat+17) < 0.1, Equals, true)
+	c.Assert(math.Abs(lng) > 179.9, Equals, true)
+
+	_, ok = g.CentralCity("XX")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestCitiesByCurrency(c *C) {
+	cities := g.CitiesByCurrency("eur", 500000)
+	c.Assert(len(cities) >= 3, Equals, true)
+	c.Assert(cities[0].City, Equals, "Berlin")
+	for _, v := range cities {
+		c.Assert(v.Country == "FR" || v.Country == "DE", Equals, true)
+		c.Assert(v.Population >= 500000, Equals, true)
+	}
+
+	c.Assert(g.CitiesByCurrency("XYZ", 0), HasLen, 0)
+}
+
+func (s *GeobedSuite) TestPopulationTier(c *C) {
+	tiers := map[int32]int{0: 0, 999: 1, 10000: 2, 99999: 2, 100000: 3, 1000000: 4, 4999999: 4, 5000000: 5}
+	for p, t := range tiers {
+		c.Assert(GeobedCity{Population: p}.PopulationTier(), Equals, t)
+	}
+	c.Assert(g.Geocode("Austin, TX").PopulationTier(), Equals, 3)
+}
+
+func (s *GeobedSuite) TestDisablePopulationScoring(c *C) {
+	c.Assert(g.Geocode("Portland").Region, Equals, "OR")
+	// The largest Portland isn't the first one in the Geonames data.
+	c.Assert(g.Geocode("Portland", GeocodeOptions{DisablePopulationScoring: true}).Region, Not(Equals), "OR")
+	// Name and region still decide.
+	c.Assert(g.Geocode("Portland, OR", GeocodeOptions{DisablePopulationScoring: true}).Region, Equals, "OR")
+}
+
+func (s *GeobedSuite) TestAliasesFor(c *C) {
+	nyc := g.Geocode("nyc")
+	aliases := g.AliasesFor(nyc)
+	c.Assert(len(aliases) > 0, Equals, true)
+	found := false
+	for _, a := range aliases {
+		c.Assert(a, Not(Equals), nyc.City)
+		if a == "Big Apple" {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	// A copy without the alternate names still finds them.
+	nyc.CityAlt = ""
+	c.Assert(g.AliasesFor(nyc), DeepEquals, aliases)
+	c.Assert(len(g.AliasesFor(GeobedCity{City: "Nowhere"})), Equals, 0)
+}
+
+func (s *GeobedSuite) TestRegionOrCountryQuery(c *C) {
+	r := g.Geocode("France")
+	c.Assert(r.City, Equals, "Paris")
+	c.Assert(r.Country, Equals, "FR")
+	c.Assert(r.MatchLevel, Equals, MatchCountry)
+
+	r = g.Geocode("texas")
+	c.Assert(r.City, Equals, "Houston")
+	c.Assert(r.MatchLevel, Equals, MatchRegion)
+
+	// A state name that's also a big city.
+	r = g.Geocode("New York")
+	c.Assert(r.City, Equals, "New York City")
+	c.Assert(r.MatchLevel, Equals, MatchCity)
+
+	c.Assert(g.Geocode("Austin, TX").MatchLevel, Equals, MatchCity)
+}
+
+func (s *GeobedSuite) TestGeocodeInNamedCountry(c *C) {
+	r := g.Geocode("Paris, France")
+	c.Assert(r.Country, Equals, "FR")
+	r = g.Geocode("Paris, United States")
+	c.Assert(r.Country, Equals, "US")
+	c.Assert(r.Region, Equals, "TX")
+
+	// No Austin in France, so nothing rather than Austin, TX.
+	r = g.Geocode("Austin, France")
+	c.Assert(r.City, Equals, "")
+	r = g.Geocode("Austin, France", GeocodeOptions{ExactCity: true})
+	c.Assert(r.City, Equals, "")
+}
+
+func (s *GeobedSuite) TestPunctuatedCountryNames(c *C) {
+	tests := []struct{ query, country, city string }{
+		{"Abidjan, Côte d'Ivoire", "CI", "Abidjan"},
+		{"Abidjan cote d’ivoire", "CI", "Abidjan"},
+		{"Dili, Timor-Leste", "TL", "Dili"},
+		{"Dili Timor Leste", "TL", "Dili"},
+		{"Basseterre, Saint Kitts and Nevis", "KN", "Basseterre"},
+		{"Basseterre, St. Kitts and Nevis", "KN", "Basseterre"},
+	}
+	for _, t := range tests {
+		nCo, _, _, nSlice := g.extractLocationPieces(t.query)
+		c.Assert(nCo, Equals, t.country, Commentf(t.query))
+		c.Assert(strings.Join(nSlice, " "), Equals, t.city, Commentf(t.query))
+
+		r := g.Geocode(t.query)
+		c.Assert(r.City, Equals, t.city, Commentf(t.query))
+		c.Assert(r.Country, Equals, t.country, Commentf(t.query))
+	}
+
+	r := g.Geocode("Timor-Leste")
+	c.Assert(r.City, Equals, "Dili")
+	c.Assert(r.MatchLevel, Equals, MatchCountry)
+}
+
+func (s *GeobedSuite) TestGeocodeInGeohash(c *C) {
+	r := g.GeocodeInGeohash("Paris", EncodeGeohash(33.5, -95.5)[:3])
+	c.Assert(r.Country, Equals, "US")
+	c.Assert(r.Region, Equals, "TX")
+
+	r = g.GeocodeInGeohash("Paris", EncodeGeohash(48.8, 2.3)[:3])
+	c.Assert(r.Country, Equals, "FR")
+	// Invalid prefixes are ignored.
+	r = g.GeocodeInGeohash("Paris", "ai!")
+	c.Assert(r.Country, Equals, "FR")
+}
+
+func (s *GeobedSuite) TestGeocodeGrouped(c *C) {
+	groups := g.GeocodeGrouped("Paris", 2)
+	c.Assert(groups["FR"][0].City, Equals, "Paris")
+	c.Assert(groups["US"][0].City, Equals, "Paris")
+	for _, cities := range groups {
+		c.Assert(len(cities) <= 2, Equals, true)
+	}
+
+	groups = g.GeocodeGrouped("Austin, TX", 1)
+	c.Assert(groups["US"][0].Region, Equals, "TX")
+	c.Assert(len(g.GeocodeGrouped("", 1)), Equals, 0)
+}
+
+func (s *GeobedSuite) TestGeocodeN(c *C) {
+	matches := g.GeocodeN("Paris", 3)
+	c.Assert(len(matches) > 1 && len(matches) <= 3, Equals, true)
+	c.Assert(matches[0].City.City, Equals, g.Geocode("Paris").City)
+	c.Assert(matches[0].City.Country, Equals, g.Geocode("Paris").Country)
+	for k := 1; k < len(matches); k++ {
+		c.Assert(matches[k].Score <= matches[k-1].Score, Equals, true)
+	}
+
+	matches = g.GeocodeN("Paris, TX", 0)
+	c.Assert(matches[0].City.Region, Equals, "TX")
+	c.Assert(len(matches) > 1, Equals, true)
+	c.Assert(g.GeocodeN("", 3), HasLen, 0)
+}
+
+func (s *GeobedSuite) TestAmbiguity(c *C) {
+	c.Assert(g.Ambiguity("Austin, TX"), Equals, 1)
+	c.Assert(g.Ambiguity("Springfield") >= 3, Equals, true)
+	c.Assert(g.Ambiguity("Springfield") > g.Ambiguity("Springfield, MO"), Equals, true)
+	c.Assert(g.Ambiguity(""), Equals, 0)
+}
+
+func (s *GeobedSuite) TestSameCity(c *C) {
+	c.Assert(g.SameCity("NYC", "New York"), Equals, true)
+	c.Assert(g.SameCity("NYC", "New York, NY"), Equals, true)
+	c.Assert(g.SameCity("Big Apple", "new york"), Equals, true)
+	c.Assert(g.SameCity("Austin Tx", "austin, TX"), Equals, true)
+
+	c.Assert(g.SameCity("Paris", "Paris, TX"), Equals, false)
+	c.Assert(g.SameCity("Palo Alto", "Stanford"), Equals, false)
+	c.Assert(g.SameCity("NYC", ""), Equals, false)
+	c.Assert(g.SameCity("France", "France"), Equals, false)
+}
+
+func (s *GeobedSuite) TestSameCityLatLng(c *C) {
+	// Both in Austin.
+	c.Assert(g.SameCityLatLng(30.26715, -97.74306, 30.27, -97.75), Equals, true)
+	// Austin and Houston.
+	c.Assert(g.SameCityLatLng(30.26715, -97.74306, 29.76328, -95.36327), Equals, false)
+	// Palo Alto and Stanford are next to each other but still different places.
+	c.Assert(g.SameCityLatLng(37.44188, -122.14302, 37.42411, -122.16608), Equals, false)
+	c.Assert(g.SameCityLatLng(91, 0, 30.26715, -97.74306), Equals, false)
+}
+
+func (s *GeobedSuite) TestHistoricNames(c *C) {
+	r := g.Geocode("Bombay")
+	c.Assert(r.City, Equals, "Mumbai")
+	c.Assert(r.MatchedAlias, Equals, "Bombay")
+	c.Assert(r.HistoricAlias, Equals, true)
+	r = g.Geocode("Peking")
+	c.Assert(r.City, Equals, "Beijing")
+	c.Assert(r.HistoricAlias, Equals, true)
+
+	// Other names aren't former names.
+	r = g.Geocode("NYC")
+	c.Assert(r.MatchedAlias, Equals, "NYC")
+	c.Assert(r.HistoricAlias, Equals, false)
+}
+
+func (s *GeobedSuite) TestResultHook(c *C) {
+	gn := g
+	gn.cfg = newConfig([]Option{WithResultHook(func(r *GeobedCity) {
+		r.Region = r.Country + "-" + r.Region
+	})})
+	c.Assert(gn.Geocode("Austin, TX").Region, Equals, "US-TX")
+	c.Assert(gn.ReverseGeocode(30.26715, -97.74306).Region, Equals, "US-TX")
+	// Not called without a result.
+	c.Assert(gn.ReverseGeocode(91, 0).Region, Equals, "")
+	// Or without a hook.
+	c.Assert(g.Geocode("Austin, TX").Region, Equals, "TX")
+}
+
+func (s *GeobedSuite) TestResultCache(c *C) {
+	gn := g
+	gn.results = newResultCache(2)
+	austin := gn.Geocode("Austin, TX")
+	c.Assert(austin.City, Equals, "Austin")
+	c.Assert(gn.results.ll.Len(), Equals, 1)
+
+	// Repeats come from the cache.
+	gn.results.add(resultCacheKey{query: "Austin, TX"}, GeobedCity{City: "Cached"})
+	c.Assert(gn.Geocode("  Austin, TX ").City, Equals, "Cached")
+	// Options are part of the key.
+	c.Assert(gn.Geocode("Austin, TX", GeocodeOptions{ExactCity: true}).City, Equals, "Austin")
+
+	// The least recently used result is dropped.
+	gn.Geocode("Boston")
+	_, ok := gn.results.get(resultCacheKey{query: "Austin, TX"})
+	c.Assert(ok, Equals, false)
+	c.Assert(gn.results.ll.Len(), Equals, 2)
+	c.Assert(gn.Geocode("Austin, TX"), DeepEquals, austin)
+
+	// The hook still runs on cached results.
+	gn.cfg = newConfig([]Option{WithResultHook(func(r *GeobedCity) { r.Region = "hooked" })})
+	c.Assert(gn.Geocode("Austin, TX").Region, Equals, "hooked")
+	c.Assert(gn.Geocode("Austin, TX").Region, Equals, "hooked")
+
+	gn.results.purge()
+	c.Assert(gn.results.ll.Len(), Equals, 0)
+	c.Assert(newResultCache(0), IsNil)
+	c.Assert(newConfig([]Option{WithCacheSize(100)}).cacheSize, Equals, 100)
+}
+
+func (s *GeobedSuite) TestInvisibleCharacters(c *C) {
+	austin := g.Geocode("Austin, TX")
+	c.Assert(g.Geocode("\u00a0Austin,\u00a0TX\u00a0"), DeepEquals, austin)
+	c.Assert(g.Geocode("\ufeffAustin, TX\u200b"), DeepEquals, austin)
+	c.Assert(g.Geocode("Aus\u200dtin,\u2003TX"), DeepEquals, austin)
+	c.Assert(g.Geocode("\u00a0\u200b"), DeepEquals, GeobedCity{})
+	c.Assert(cleanQuery("\ufeff New\u00a0York\u200c "), Equals, "New York")
+}
+
+func (s *GeobedSuite) TestGluedRegion(c *C) {
+	r := g.Geocode("AustinTX")
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(r.Region, Equals, "TX")
+	r = g.Geocode("ParisFR")
+	c.Assert(r.City, Equals, "Paris")
+	c.Assert(r.Country, Equals, "FR")
+	// The other ways of geocoding split it too.
+	groups := g.GeocodeGrouped("AustinTX", 1)
+	c.Assert(groups["US"], HasLen, 1)
+	c.Assert(groups["US"][0].City, Equals, "Austin")
+	c.Assert(groups["US"][0].Region, Equals, "TX")
+	c.Assert(g.Ambiguity("AustinTX"), Equals, 1)
+
+	c.Assert(g.unglued("AustinTX"), Equals, "Austin, TX")
+	c.Assert(g.unglued("ZürichCH"), Equals, "Zürich, CH")
+	// Not codes.
+	c.Assert(g.unglued("Dallas"), Equals, "Dallas")
+	c.Assert(g.unglued("USA"), Equals, "USA")
+	c.Assert(g.unglued("AustinZZ"), Equals, "AustinZZ")
+	c.Assert(g.unglued("Austin TX"), Equals, "Austin TX")
+}
+
+func (s *GeobedSuite) TestGeocodeFunc(c *C) {
+	same := func(c GeobedCity, score int) int {
+		return score
+	}
+	for _, q := range []string{"Paris", "Austin, TX", "New York", "NYC", "near Boston"} {
+		c.Assert(g.GeocodeFunc(q, same), DeepEquals, g.Geocode(q))
+	}
+
+	// Favor the US.
+	r := g.GeocodeFunc("Paris", func(c GeobedCity, score int) int {
+		if c.Country == "US" {
+			return score + 100
+		}
+		return score
+	})
+	c.Assert(r.City, Equals, "Paris")
+	c.Assert(r.Country, Equals, "US")
+
+	c.Assert(g.GeocodeFunc("", same), DeepEquals, GeobedCity{})
+}
+
+func (s *GeobedSuite) TestGeocodeApproximate(c *C) {
+	r, conf, ok := g.GeocodeApproximate("123 Main St, Austin, TX 78701")
+	c.Assert(r.City, Equals, "Austin")
+	c.Assert(r.Region, Equals, "TX")
+	c.Assert(conf, Equals, 1.0)
+	c.Assert(ok, Equals, true)
+
+	r, conf, ok = g.GeocodeApproximate("NYC")
+	c.Assert(r.City, Equals, "New York City")
+	c.Assert(conf, Equals, 1.0)
+	c.Assert(ok, Equals, true)
+
+	// A town that isn't there gets a guess, just not one to trust.
+	r, conf, ok = g.GeocodeApproximate("Frobnitzburg")
+	c.Assert(r.City, Not(Equals), "")
+	c.Assert(conf < approximateMinConfidence, Equals, true)
+	c.Assert(ok, Equals, false)
+
+	_, conf, ok = g.GeocodeApproximate("Texas")
+	c.Assert(conf, Equals, 1.0)
+	c.Assert(ok, Equals, true)
+	_, conf, ok = g.GeocodeApproximate("")
+	c.Assert(conf, Equals, 0.0)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestNormalize(c *C) {
+	// German spellings without umlauts.
+	umlauts := strings.NewReplacer("ae", "a", "oe", "o", "ue", "u")
+	gn := g
+	gn.cfg = newConfig([]Option{WithNormalize(func(s string) string {
+		return umlauts.Replace(foldLower(s))
+	})})
+	gn.indexAltNames()
+	c.Assert(gn.cfg.fold("Zürich"), Equals, "zurich")
+	c.Assert(gn.cfg.fold("Koeln"), Equals, "koln")
+	c.Assert(gn.Geocode("Koeln").City, Equals, "Köln")
+	c.Assert(gn.Geocode("Duesseldorf").City, Equals, "Düsseldorf")
+	c.Assert(gn.CitiesByName("Koeln"), Not(HasLen), 0)
+
+	c.Assert(g.cfg.fold("Koeln"), Equals, "koeln")
+
+	// A Turkish normalizer, where I lowercases to the dotless ı. The city names are normalized with it as they're loaded, so they're
+	// sorted (and searched) the same way as the queries.
+	turkish := strings.NewReplacer("I", "ı", "İ", "i")
+	tg := GeoBed{cfg: newConfig([]Option{WithDataDir(g.cfg.dataDir), WithNormalize(func(s string) string {
+		return strings.ToLower(turkish.Replace(s))
+	})})}
+	c.Assert(tg.loadDataSets(), IsNil)
+	tg.indexAltNames()
+	tg.indexCountries()
+	for _, v := range tg.c {
+		c.Assert(v.CityLower, Equals, tg.cfg.fold(v.City))
+	}
+	c.Assert(tg.Geocode("ISTANBUL").City, Equals, "Istanbul")
+	c.Assert(tg.Geocode("izmir").City, Equals, "İzmir")
+	ac := tg.Autocomplete("Ist", 1)
+	c.Assert(ac, HasLen, 1)
+	c.Assert(ac[0].City, Equals, "Istanbul")
+	c.Assert(ac[0].CityLower, Equals, "ıstanbul")
+	c.Assert(tg.Autocomplete("İzm", 1)[0].City, Equals, "İzmir")
+}
+
+func (s *GeobedSuite) TestNeighborhoods(c *C) {
+	r := g.Geocode("Brooklyn")
+	c.Assert(r.City, Equals, "New York City")
+	c.Assert(r.MatchedAlias, Equals, "Brooklyn")
+	c.Assert(g.Geocode("Brooklyn, NY").City, Equals, "New York City")
+	c.Assert(g.Geocode("shibuya").City, Equals, "Tokyo")
+
+	// The state rules out New York City.
+	r = g.Geocode("Brooklyn, MI")
+	c.Assert(r.City, Equals, "Brooklyn")
+	c.Assert(r.Region, Equals, "MI")
+
+	gn := g
+	gn.cfg.neighborhoods = false
+	c.Assert(gn.Geocode("Shibuya").City, Not(Equals), "Tokyo")
+}
+
+func (s *GeobedSuite) TestErrors(c *C) {
+	_, err := g.ReverseGeocodeContext(context.Background(), 91, 0)
+	c.Assert(errors.Is(err, ErrInvalidCoordinate), Equals, true)
+	c.Assert(g.ReverseGeocode(30, 200).City, Equals, "")
+
+	dir := c.MkDir()
+	_, err = loadGeobedCacheMeta(os.DirFS(dir))
+	c.Assert(errors.Is(err, ErrDataNotFound), Equals, true)
+	c.Assert(errors.Is(err, os.ErrNotExist), Equals, true)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "g.c.bin"), []byte("garbage"), 0666), IsNil)
+	_, err = loadGeobedCityData(os.DirFS(dir), CacheBinary)
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, true)
+	c.Assert(errors.Is(err, ErrDataNotFound), Equals, false)
+}
+
+func (s *GeobedSuite) TestFoldName(c *C) {
+	c.Assert(foldName("Zürich"), Equals, "Zurich")
+	c.Assert(foldName("Düsseldorf"), Equals, "Dusseldorf")
+	c.Assert(foldName("São Paulo"), Equals, "Sao Paulo")
+	c.Assert(foldName("Straße"), Equals, "Strasse")
+	c.Assert(foldName("Austin"), Equals, "Austin")
+	c.Assert(foldLower("ZÜRICH"), Equals, "zurich")
+	// Combining marks written separately, Vietnamese and Greek.
+	c.Assert(foldName("Zu\u0308rich"), Equals, "Zurich")
+	c.Assert(foldName("Hà Nội"), Equals, "Ha Noi")
+	c.Assert(foldName("Ηράκλειο"), Equals, "Ηρακλειο")
+	c.Assert(foldName("Йошкар-Ола"), Equals, "Иошкар-Ола")
+	c.Assert(foldName("Kraków"), Equals, "Krakow")
+	c.Assert(foldLower("BOGOTÁ"), Equals, "bogota")
+	c.Assert(foldLower("Montréal"), Equals, "montreal")
+	c.Assert(foldLower("МОСКВА"), Equals, "москва")
+	// ASCII name columns that aren't, in UTF-8 and in Latin-1.
+	c.Assert(asciiName("Medellín"), Equals, "medellin")
+	c.Assert(asciiName("quer\xe9taro"), Equals, "queretaro")
+	c.Assert(asciiName("austin"), Equals, "austin")
+}
+
+// Accented names are matched without their accents and the other way around, while the accented name is kept for display.
+func (s *GeobedSuite) TestAccentedNames(c *C) {
+	for q, city := range map[string]string{"Zurich": "Zürich", "Koln": "Köln", "Malmö": "Malmö", "Montreal, Canada": "Montréal", "Sao Paulo, Brazil": "São Paulo",
+		"Sâo Paulo": "São Paulo", "Mérida": "Mérida", "Merida": "Mérida"} {
+		r := g.Geocode(q)
+		c.Assert(r.City, Equals, city, Commentf("query %q", q))
+		c.Assert(r.CityLower, Equals, foldLower(city))
+	}
+
+	// The MaxMind ASCII name column has Latin-1 accents in a few places (ie. "querétaro").
+	for _, v := range g.c {
+		c.Assert(utf8.ValidString(v.CityLower), Equals, true, Commentf("%q", v.CityLower))
+		if v.City == "Querétaro" {
+			c.Assert(v.CityLower, Equals, "queretaro")
+		}
+	}
+}
+
 func (s *GeobedSuite) TestToUpper(c *C) {
 	c.Assert(toUpper("nyc"), Equals, "NYC")
 }
@@ -113,6 +1174,1173 @@ func (s *GeobedSuite) TestToLower(c *C) {
 	c.Assert(toLower("NYC"), Equals, "nyc")
 }
 
+func (s *GeobedSuite) TestLoadFields(c *C) {
+	city := GeobedCity{City: "Austin", CityAlt: "Ostin", Population: 931830, Geohash: "9v6kpmr1e2ck", Timezone: "America/Chicago"}
+	cfg := newConfig([]Option{WithLoadFields(FieldCityAlt)})
+	cfg.trimFields(&city)
+	c.Assert(city.City, Equals, "Austin")
+	c.Assert(city.CityAlt, Equals, "Ostin")
+	c.Assert(city.Geohash, Equals, "")
+	c.Assert(city.Population, Equals, int32(0))
+	c.Assert(city.Timezone, Equals, "")
+
+	c.Assert(newConfig(nil).fields, Equals, AllFields)
+}
+
+func (s *GeobedSuite) TestTimezone(c *C) {
+	c.Assert(g.Geocode("Austin, TX").Timezone, Equals, "America/Chicago")
+	c.Assert(g.ReverseGeocode(-18.14161, 178.44149).Timezone, Equals, "Pacific/Fiji")
+}
+
+func (s *GeobedSuite) TestElevation(c *C) {
+	row := func(name, elevation, dem string) string {
+		return strings.Join([]string{"1", name, name, "", "30.1", "-97.1", "P", "PPL", "US", "", "TX", "", "", "", "100", elevation, dem, "America/Chicago", "2015-09-01"}, "\t") + "\n"
+	}
+	data := row("Surveyed", "149", "150") + row("Modeled", "", "12") + row("Unknown", "", "-9999")
+
+	mg := GeoBed{cfg: newConfig([]Option{WithLoadFields(FieldCityAlt), WithExtendedFields()})}
+	c.Assert(mg.cfg.fields, Equals, FieldCityAlt|FieldElevation)
+	mg.loadGeonamesCities(strings.NewReader(data))
+	elevations := map[string]int32{}
+	for _, v := range mg.c {
+		elevations[v.City] = v.Elevation
+		c.Assert(v.FeatureCode, Equals, "")
+	}
+	c.Assert(elevations, DeepEquals, map[string]int32{"Surveyed": 149, "Modeled": 12, "Unknown": 0})
+
+	// Not loaded by default.
+	mg = GeoBed{cfg: newConfig(nil)}
+	mg.loadGeonamesCities(strings.NewReader(data))
+	c.Assert(mg.c[0].Elevation, Equals, int32(0))
+	c.Assert(mg.c[0].FeatureCode, Equals, "PPL")
+}
+
+func (s *GeobedSuite) TestLoadMaxMindCities(c *C) {
+	data := "Country,City,AccentCity,Region,Population,Latitude,Longitude\n" +
+		"us,austin,Austin,TX,,30.2669444,-97.7427778\n" +
+		"us,\"washington, d.c.\",\"Washington, D.C.\",DC,,38.8951111,-77.0363889\n" +
+		"us,bad!name,Bad!name,TX,,31.1,-98.1\n" +
+		"us,round rock,Round Rock,tx,,30.5083333,-97.6786111\n" +
+		"us,dallas,Dallas,48,,32.7833333,-96.8\n"
+
+	mg := GeoBed{cfg: newConfig(nil)}
+	mg.loadMaxMindCities(strings.NewReader(data))
+	c.Assert(len(mg.c), Equals, 4)
+
+	names := map[string]GeobedCity{}
+	for _, v := range mg.c {
+		names[v.City] = v
+	}
+	c.Assert(names["Austin"].Region, Equals, "TX")
+	c.Assert(names["Austin"].Timezone, Equals, "")
+	// Regions are stored uppercase, while still matched regardless of case.
+	c.Assert(names["Round Rock"].Region, Equals, "TX")
+	// As are US states that are FIPS codes.
+	c.Assert(names["Dallas"].Region, Equals, "TX")
+	c.Assert(canonicalRegion(" eng"), Equals, "ENG")
+	r := g.Geocode("Austin, tx")
+	c.Assert(r.Region, Equals, "TX")
+	c.Assert(names["Washington, D.C."].CityLower, Equals, "washington, d.c.")
+	c.Assert(names["Washington, D.C."].Country, Equals, "US")
+	c.Assert(names["Washington, D.C."].Region, Equals, "DC")
+}
+
+func (s *GeobedSuite) TestRegionCrosswalk(c *C) {
+	c.Assert(GeonamesRegion("ch", "25"), Equals, "ZH")
+	c.Assert(GeonamesRegion("FR", "A8"), Equals, "11")
+	c.Assert(GeonamesRegion("SE", "26"), Equals, "26")
+	c.Assert(GeonamesRegion("US", "TX"), Equals, "TX")
+
+	data := "Country,City,AccentCity,Region,Population,Latitude,Longitude\n" +
+		"ch,zurich,Zürich,25,,47.366667,8.55\n" +
+		"se,stockholm,Stockholm,26,,59.333333,18.05\n"
+	for _, on := range []bool{false, true} {
+		mg := GeoBed{cfg: newConfig([]Option{WithRegionCrosswalk(on)})}
+		mg.loadMaxMindCities(strings.NewReader(data))
+		regions := map[string]string{}
+		for _, v := range mg.c {
+			regions[v.City] = v.Region
+		}
+		if on {
+			c.Assert(regions["Zürich"], Equals, "ZH")
+		} else {
+			c.Assert(regions["Zürich"], Equals, "25")
+		}
+		c.Assert(regions["Stockholm"], Equals, "26")
+	}
+}
+
+func (s *GeobedSuite) TestBoundingBox(c *C) {
+	europe := BoundingBox{MinLat: 35, MinLng: -25, MaxLat: 72, MaxLng: 45}
+	mg := GeoBed{cfg: newConfig([]Option{WithBoundingBox(europe)})}
+	mg.cfg.dataDir = g.cfg.dataDir
+	c.Assert(mg.loadDataSets(), IsNil)
+	c.Assert(len(mg.c) > 0 && len(mg.c) < len(g.c), Equals, true)
+	names := map[string]bool{}
+	for _, v := range mg.c {
+		c.Assert(europe.contains(v.Latitude, v.Longitude), Equals, true)
+		names[v.City] = true
+	}
+	c.Assert(names["Paris"], Equals, true)
+	c.Assert(names["Köln"], Equals, true)
+	c.Assert(names["Austin"], Equals, false)
+	c.Assert(mg.co, DeepEquals, g.co)
+
+	// Crossing the antimeridian.
+	pacific := BoundingBox{MinLat: -30, MinLng: 170, MaxLat: 0, MaxLng: -170}
+	c.Assert(pacific.contains(-18, 178), Equals, true)
+	c.Assert(pacific.contains(-18, -175), Equals, true)
+	c.Assert(pacific.contains(-18, 0), Equals, false)
+
+	c.Assert(sameBounds(nil, nil), Equals, true)
+	c.Assert(sameBounds(&europe, nil), Equals, false)
+	c.Assert(sameBounds(&europe, &BoundingBox{MinLat: 35, MinLng: -25, MaxLat: 72, MaxLng: 45}), Equals, true)
+}
+
+func (s *GeobedSuite) TestWithDataSources(c *C) {
+	ids := func(mg GeoBed) []string {
+		ids := []string{}
+		for _, d := range mg.DataSources() {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+	geonames := GeoBed{cfg: newConfig([]Option{WithDataDir(g.cfg.dataDir), WithDataSources(SourceGeonames)})}
+	c.Assert(ids(geonames), DeepEquals, []string{"geonamesCities1000", "geonamesCountryInfo", "geonamesAdmin1Codes"})
+	maxmind := GeoBed{cfg: newConfig([]Option{WithDataDir(g.cfg.dataDir), WithDataSources(" MaxMind ")})}
+	c.Assert(ids(maxmind), DeepEquals, []string{"geonamesCountryInfo", "maxmindWorldCities", "geonamesAdmin1Codes"})
+	both := GeoBed{cfg: newConfig([]Option{WithDataSources(SourceMaxMind, SourceGeonames)})}
+	c.Assert(both.cfg.sources, DeepEquals, []string{"geonames", "maxmind"})
+	c.Assert(ids(both), HasLen, len(dataSetFiles))
+
+	c.Assert(geonames.loadDataSets(), IsNil)
+	c.Assert(maxmind.loadDataSets(), IsNil)
+	c.Assert(len(geonames.c) > 0 && len(maxmind.c) > 0 && len(geonames.c)+len(maxmind.c) >= len(g.c), Equals, true)
+	// Only Geonames has the time zones.
+	for _, v := range maxmind.c {
+		c.Assert(v.Timezone, Equals, "")
+	}
+	c.Assert(geonames.co, DeepEquals, g.co)
+	c.Assert(maxmind.co, DeepEquals, g.co)
+}
+
+func (s *GeobedSuite) TestMinPopulation(c *C) {
+	mg := GeoBed{cfg: newConfig([]Option{WithDataDir(g.cfg.dataDir), WithMinPopulation(100000)})}
+	c.Assert(mg.loadDataSets(), IsNil)
+	c.Assert(len(mg.c) > 0 && len(mg.c) < len(g.c), Equals, true)
+	for _, v := range mg.c {
+		c.Assert(v.Population >= 100000, Equals, true)
+	}
+
+	// Along with the cities that have no population.
+	mg = GeoBed{cfg: newConfig([]Option{WithDataDir(g.cfg.dataDir), WithMinPopulation(100000), WithKeepUnknownPopulation(true)})}
+	c.Assert(mg.loadDataSets(), IsNil)
+	unknown := 0
+	for _, v := range mg.c {
+		c.Assert(v.Population >= 100000 || v.Population == 0, Equals, true)
+		if v.Population == 0 {
+			unknown++
+		}
+	}
+	c.Assert(unknown > 0, Equals, true)
+	c.Assert(len(mg.c) < len(g.c), Equals, true)
+}
+
+func (s *GeobedSuite) TestCleanCityName(c *C) {
+	cfg := newConfig(nil)
+	tests := map[string]string{
+		" Austin ":         "Austin",
+		"(Dirty)":          "Dirty",
+		"Springfield 2":    "Springfield",
+		"- Austin -":       "Austin",
+		"23 de Enero":      "23 de Enero",
+		"Winston-Salem":    "Winston-Salem",
+		"Sankt Gallen (1)": "Sankt Gallen (1)",
+	}
+	for in, out := range tests {
+		name, keep := cfg.cleanCityName(in)
+		c.Assert(keep, Equals, true)
+		c.Assert(name, Equals, out)
+	}
+	for _, in := range []string{"Bad!name", "a@b", "", " ( ) ", "42"} {
+		_, keep := cfg.cleanCityName(in)
+		c.Assert(keep, Equals, false)
+	}
+
+	// Loosened rules.
+	cfg = newConfig([]Option{WithCityNameRules(CityNameRules{Trim: " "})})
+	name, keep := cfg.cleanCityName("Bad!name 2")
+	c.Assert(keep, Equals, true)
+	c.Assert(name, Equals, "Bad!name 2")
+}
+
+func (s *GeobedSuite) TestOpenDataFile(c *C) {
+	dir := c.MkDir()
+	plain := filepath.Join(dir, "countryInfo.txt")
+	c.Assert(ioutil.WriteFile(plain, []byte("US\tUSA\n"), 0666), IsNil)
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("US\tUSA\n"))
+	zw.Close()
+	gzipped := filepath.Join(dir, "countryInfo.txt.gz")
+	c.Assert(ioutil.WriteFile(gzipped, b.Bytes(), 0666), IsNil)
+
+	for _, p := range []string{plain, gzipped} {
+		fi, err := openDataFile(p)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(fi)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "US\tUSA\n")
+		c.Assert(fi.Close(), IsNil)
+		c.Assert(isZipFile(p), Equals, false)
+	}
+}
+
+func (s *GeobedSuite) TestDataArchive(c *C) {
+	dir := c.MkDir()
+	archive := filepath.Join(dir, "geobed-data.tar.gz")
+	fh, err := os.Create(archive)
+	c.Assert(err, IsNil)
+	gz := gzip.NewWriter(fh)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"cities1000.zip", "countryInfo.txt", "worldcitiespop.txt.gz"} {
+		b, err := ioutil.ReadFile(filepath.Join(g.cfg.dataDir, name))
+		c.Assert(err, IsNil)
+		c.Assert(tw.WriteHeader(&tar.Header{Name: "data/" + name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}), IsNil)
+		_, err = tw.Write(b)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	c.Assert(fh.Close(), IsNil)
+
+	files, err := readDataArchive(archive)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 3)
+
+	// The data directory is empty, so everything has to come from the archive.
+	mg := GeoBed{cfg: newConfig([]Option{WithDataArchive(archive)})}
+	mg.cfg.dataDir = c.MkDir()
+	c.Assert(mg.downloadDataSets(context.Background()), IsNil)
+	c.Assert(mg.loadDataSets(), IsNil)
+	c.Assert(len(mg.c), Equals, len(g.c))
+	c.Assert(mg.co, DeepEquals, g.co)
+
+	c.Assert(fileStem("./geobed-data/worldcitiespop.txt.gz"), Equals, "worldcitiespop")
+	c.Assert(newConfig([]Option{WithDataArchive("https://example.com/mirror/geobed.tar.gz")}).archivePath(), Equals, filepath.Join(defaultDataDir(), "geobed.tar.gz"))
+}
+
+func (s *GeobedSuite) TestBinaryCache(c *C) {
+	dir := c.MkDir()
+	cities := []GeobedCity{
+		{City: "São Paulo", CityLower: "sao paulo", CityAlt: "Sao Paulo", Country: "BR", Region: "27", Latitude: -23.5475, Longitude: -46.63611, Population: 10021295, Geohash: "6gyf4bf8m0uh"},
+		{City: "Austin", CityLower: "austin", Country: "US", Region: "TX", Latitude: 30.26715, Longitude: -97.74306},
+	}
+	countries := []CountryInfo{{Country: "Brazil", Capital: "Brasilia", Area: 8511965, ISONumeric: 76, ISO: "BR", ISO3: "BRA", Neighbours: "SR,PE,BO"}}
+
+	c.Assert(storeCitiesBinary(filepath.Join(dir, "g.c.bin"), cities), IsNil)
+	c.Assert(storeCountriesBinary(filepath.Join(dir, "g.co.bin"), countries), IsNil)
+
+	lc, err := loadCitiesBinary(os.DirFS(dir), "g.c.bin")
+	c.Assert(err, IsNil)
+	c.Assert(lc, DeepEquals, cities)
+	lco, err := loadCountriesBinary(os.DirFS(dir), "g.co.bin")
+	c.Assert(err, IsNil)
+	c.Assert(lco, DeepEquals, countries)
+
+	// The kinds of data can't be mixed up.
+	_, err = loadCitiesBinary(os.DirFS(dir), "g.co.bin")
+	c.Assert(err, NotNil)
+
+	// A damaged string length isn't allocated.
+	c.Assert(writeBinaryFile(filepath.Join(dir, "g.c.bin"), func(bw *binWriter) {
+		bw.header(binaryKindCities, 1)
+		bw.write(uint32(0xFFFFFFF0))
+	}), IsNil)
+	_, err = loadGeobedCityData(os.DirFS(dir), CacheBinary)
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, true)
+	c.Assert(err, ErrorMatches, ".*too long.*")
+}
+
+func (s *GeobedSuite) TestPurgeCache(c *C) {
+	dir := c.MkDir()
+	for _, f := range append(cacheFiles, "cities1000.zip") {
+		err := ioutil.WriteFile(filepath.Join(dir, f), []byte("x"), 0666)
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(PurgeCache(dir), IsNil)
+	for _, f := range cacheFiles {
+		_, err := os.Stat(filepath.Join(dir, f))
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+	// Source files are kept unless asked for.
+	_, err := os.Stat(filepath.Join(dir, "cities1000.zip"))
+	c.Assert(err, IsNil)
+
+	c.Assert(PurgeDataSets(dir), IsNil)
+	_, err = os.Stat(filepath.Join(dir, "cities1000.zip"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(PurgeDataSets(dir), IsNil)
+}
+
+func (s *GeobedSuite) TestSourceDataDate(c *C) {
+	c.Assert(g.SourceDataDate().IsZero(), Equals, false)
+
+	dir := c.MkDir()
+	downloaded := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	path := filepath.Join(dir, "cities1000.zip")
+	c.Assert(ioutil.WriteFile(path, []byte("x"), 0644), IsNil)
+	c.Assert(os.Chtimes(path, downloaded, downloaded), IsNil)
+
+	lastModified := downloaded.Add(-time.Hour)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "HEAD")
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}))
+	defer ts.Close()
+	defer func(f []map[string]string) { dataSetFiles = f }(dataSetFiles)
+	dataSetFiles = []map[string]string{{"url": ts.URL + "/cities1000.zip", "path": "./geobed-data/cities1000.zip", "id": "geonamesCities1000"}}
+	mg := GeoBed{cfg: newConfig(nil)}
+	mg.cfg.dataDir = dir
+
+	// Published before it was downloaded, so nothing new.
+	ok, err := mg.UpdateAvailable()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	lastModified = downloaded.Add(time.Hour)
+	ok, err = mg.UpdateAvailable()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	// Or never downloaded at all.
+	lastModified = downloaded.Add(-time.Hour)
+	c.Assert(os.Remove(path), IsNil)
+	ok, err = mg.UpdateAvailable()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	// Archives aren't checked.
+	mg.cfg.dataArchive = "/srv/geobed-data.tar.gz"
+	ok, err = mg.UpdateAvailable()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestDataSources(c *C) {
+	ds := g.DataSources()
+	c.Assert(ds, HasLen, len(dataSetFiles))
+	for k, d := range ds {
+		c.Assert(d.ID, Equals, dataSetFiles[k]["id"])
+		c.Assert(d.URL, Equals, dataSetFiles[k]["url"])
+		c.Assert(d.Path, Equals, filepath.Join(g.cfg.dataDir, filepath.Base(dataSetFiles[k]["path"])))
+		c.Assert(d.Downloaded, Equals, true)
+		c.Assert(d.Archive, Equals, "")
+	}
+
+	mg := GeoBed{cfg: newConfig([]Option{WithDataArchive("/srv/geobed-data.tar.gz")})}
+	mg.cfg.dataDir = c.MkDir()
+	for _, d := range mg.DataSources() {
+		c.Assert(d.Downloaded, Equals, false)
+		c.Assert(d.Archive, Equals, "/srv/geobed-data.tar.gz")
+	}
+}
+
+func (s *GeobedSuite) TestWriteCitiesJSON(c *C) {
+	var buf bytes.Buffer
+	c.Assert(WriteCitiesJSON(&buf, g.c[:10]), IsNil)
+	var cities []GeobedCity
+	c.Assert(json.Unmarshal(buf.Bytes(), &cities), IsNil)
+	c.Assert(cities, DeepEquals, []GeobedCity(g.c[:10]))
+	c.Assert(strings.HasPrefix(buf.String(), `[{"city":`), Equals, true)
+
+	buf.Reset()
+	c.Assert(WriteCitiesJSON(&buf, nil), IsNil)
+	c.Assert(buf.String(), Equals, "[]\n")
+}
+
+func (s *GeobedSuite) TestPopulation(c *C) {
+	c.Assert(g.PopulationAt(30.26, -97.74), Equals, g.ReverseGeocode(30.26, -97.74).Population)
+	c.Assert(g.PopulationAt(30.26, -97.74) > 0, Equals, true)
+	c.Assert(g.PopulationAt(91, 0), Equals, int32(0))
+
+	// Palo Alto and Stanford, but not San Jose which is further out.
+	near := g.PopulationInRadius(37.43, -122.15, 10)
+	c.Assert(near >= int64(g.Geocode("Palo Alto, CA").Population+g.Geocode("Stanford, CA").Population), Equals, true)
+	c.Assert(g.PopulationInRadius(37.43, -122.15, 30) >= near+int64(g.Geocode("San Jose, CA").Population), Equals, true)
+	// Paris is in both data sets but only counts once.
+	paris := int64(g.Geocode("Paris, France").Population)
+	total := g.PopulationInRadius(48.8534, 2.3488, 2)
+	c.Assert(total >= paris && total < paris*3/2, Equals, true)
+	c.Assert(g.PopulationInRadius(0, -140, 100), Equals, int64(0))
+	c.Assert(g.PopulationInRadius(91, 0, 100), Equals, int64(0))
+	c.Assert(g.PopulationInRadius(math.NaN(), -97.74, 100), Equals, int64(0))
+	c.Assert(g.PopulationInRadius(30.26, 181, 100), Equals, int64(0))
+	c.Assert(g.PopulationInRadius(30.26, -97.74, -1), Equals, int64(0))
+	c.Assert(g.PopulationInRadius(30.26, -97.74, math.NaN()), Equals, int64(0))
+}
+
+func (s *GeobedSuite) TestValidate(c *C) {
+	c.Assert(g.Validate(), IsNil)
+
+	mg := GeoBed{c: make(Cities, len(g.c)), cityNameIdx: g.cityNameIdx}
+	copy(mg.c, g.c)
+	c.Assert(mg.Validate(), IsNil)
+
+	mg.c[1], mg.c[len(mg.c)-1] = mg.c[len(mg.c)-1], mg.c[1]
+	err := mg.Validate()
+	c.Assert(errors.Is(err, ErrInvalidData), Equals, true)
+	c.Assert(err, ErrorMatches, ".*aren't sorted.*")
+	mg.c[1], mg.c[len(mg.c)-1] = mg.c[len(mg.c)-1], mg.c[1]
+
+	mg.c[2].Geohash = "9v6kn"
+	c.Assert(mg.Validate(), ErrorMatches, ".*invalid geohash.*")
+	mg.c[2].Geohash = g.c[2].Geohash
+
+	mg.c = mg.c[:1]
+	c.Assert(mg.Validate(), ErrorMatches, ".*out of range.*")
+
+	c.Assert((&GeoBed{}).Validate(), ErrorMatches, ".*no cities.*")
+
+	// Names that don't start with an ASCII letter, ie. without an ASCII name.
+	mg = GeoBed{c: Cities{{City: "Austin", CityLower: "austin"}, {City: "Москва", CityLower: "москва"}}}
+	mg.cityNameIdx = map[string]int{"a": 0, string("москва"[0]): 1}
+	c.Assert(mg.Validate(), IsNil)
+}
+
+func (s *GeobedSuite) TestSampleCities(c *C) {
+	for _, weighted := range []bool{false, true} {
+		cities := g.SampleCities(5, weighted)
+		c.Assert(cities, HasLen, 5)
+		seen := map[GeobedCity]bool{}
+		for _, v := range cities {
+			c.Assert(seen[v], Equals, false)
+			seen[v] = true
+		}
+		c.Assert(g.SampleCities(0, weighted), HasLen, 0)
+		c.Assert(g.SampleCities(len(g.c)+1, weighted), HasLen, len(g.c))
+	}
+
+	// Weighted picks are bigger cities on average.
+	var plain, weighted int64
+	for i := 0; i < 10; i++ {
+		for _, v := range g.SampleCities(10, false) {
+			plain += int64(v.Population)
+		}
+		for _, v := range g.SampleCities(10, true) {
+			weighted += int64(v.Population)
+		}
+	}
+	c.Assert(weighted > plain, Equals, true)
+}
+
+func (s *GeobedSuite) TestCitiesInDirection(c *C) {
+	c.Assert(bearing(0, 0, 10, 0), Equals, 0.0)
+	c.Assert(math.Abs(bearing(0, 0, 0, 10)-90) < 1e-9, Equals, true)
+	c.Assert(math.Abs(bearing(0, 0, -10, 0)-180) < 1e-9, Equals, true)
+	c.Assert(math.Abs(bearing(0, 10, 0, 0)-270) < 1e-9, Equals, true)
+
+	// From Stanford, Palo Alto is just to the northeast and San Francisco further away to the northwest. San Jose is to the southeast.
+	names := func(cities []GeobedCity) []string {
+		n := []string{}
+		for _, v := range cities {
+			if v.City == "Palo Alto" || v.City == "San Francisco" || v.City == "San Jose" {
+				n = append(n, v.City)
+			}
+		}
+		return n
+	}
+	north := g.CitiesInDirection(37.42411, -122.16608, 0, 60, 60)
+	c.Assert(names(north), DeepEquals, []string{"Palo Alto", "San Francisco"})
+	for k := 1; k < len(north); k++ {
+		c.Assert(Distance(37.42411, -122.16608, north[k].Latitude, north[k].Longitude) >= Distance(37.42411, -122.16608, north[k-1].Latitude, north[k-1].Longitude), Equals, true)
+	}
+	c.Assert(names(g.CitiesInDirection(37.42411, -122.16608, 300, 45, 60)), DeepEquals, []string{"San Francisco"})
+	c.Assert(names(g.CitiesInDirection(37.42411, -122.16608, 135, 45, 60)), DeepEquals, []string{"San Jose"})
+	// Too far.
+	c.Assert(names(g.CitiesInDirection(37.42411, -122.16608, 300, 45, 20)), DeepEquals, []string{})
+	c.Assert(g.CitiesInDirection(91, 0, 0, 45, 100), HasLen, 0)
+}
+
+func (s *GeobedSuite) TestSchemaOrgPlace(c *C) {
+	b, err := GeobedCity{City: "Austin", Country: "US", Region: "TX", Latitude: 30.26715, Longitude: -97.74306}.SchemaOrgPlace()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `{"@context":"https://schema.org","@type":"Place","name":"Austin",`+
+		`"geo":{"@type":"GeoCoordinates","latitude":30.26715,"longitude":-97.74306},`+
+		`"address":{"@type":"PostalAddress","addressLocality":"Austin","addressRegion":"TX","addressCountry":"US"}}`)
+}
+
+func (s *GeobedSuite) TestGeoJSON(c *C) {
+	city := GeobedCity{City: "Austin", CityLower: "austin", Country: "US", Region: "TX", Latitude: 30.26715, Longitude: -97.74306, Population: 931830,
+		Timezone: "America/Chicago"}
+	b, err := city.GeoJSON()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `{"type":"Feature","geometry":{"type":"Point","coordinates":[-97.74306,30.26715]},`+
+		`"properties":{"city":"Austin","city_lower":"austin","country":"US","region":"TX","latitude":30.26715,"longitude":-97.74306,`+
+		`"population":931830,"timezone":"America/Chicago","match_level":0}}`)
+
+	// The properties are the city as it's marshaled on its own.
+	var f struct {
+		Type     string
+		Geometry struct {
+			Type        string
+			Coordinates []float64
+		}
+		Properties GeobedCity
+	}
+	r := g.ReverseGeocode(30.26715, -97.74306)
+	b, err = r.GeoJSON()
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(b, &f), IsNil)
+	c.Assert(f.Type, Equals, "Feature")
+	c.Assert(f.Geometry.Type, Equals, "Point")
+	c.Assert(f.Geometry.Coordinates, DeepEquals, []float64{r.Longitude, r.Latitude})
+	c.Assert(f.Properties, DeepEquals, r)
+}
+
+func (s *GeobedSuite) TestNearestNeighbourCountry(c *C) {
+	// Canada is closer to Boston than Mexico is.
+	co, ok := g.NearestNeighbourCountry(42.35843, -71.05977)
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "CA")
+	// From San Diego it's the other way around.
+	co, ok = g.NearestNeighbourCountry(32.71571, -117.16472)
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "MX")
+
+	// Australia has no neighbors.
+	_, ok = g.NearestNeighbourCountry(-33.86785, 151.20732)
+	c.Assert(ok, Equals, false)
+	_, ok = g.NearestNeighbourCountry(91, 0)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestCountryHull(c *C) {
+	hull := g.CountryHull("us")
+	c.Assert(len(hull) >= 3, Equals, true)
+	// The Aleutian Islands cross the antimeridian.
+	_, minLng, _, maxLng, _ := g.CountryBounds("US")
+	x := func(c GeobedCity) float64 {
+		if minLng > maxLng && c.Longitude < 0 {
+			return c.Longitude + 360
+		}
+		return c.Longitude
+	}
+	// Every city is inside the hull (or on it), to the left of each edge going counterclockwise.
+	for _, v := range g.c {
+		if v.Country != "US" || (v.Latitude == 0 && v.Longitude == 0) {
+			continue
+		}
+		for i := range hull {
+			a, b := hull[i], hull[(i+1)%len(hull)]
+			cross := (x(b)-x(a))*(v.Latitude-a.Latitude) - (b.Latitude-a.Latitude)*(x(v)-x(a))
+			c.Assert(cross >= -1e-9, Equals, true, Commentf("%s is outside of the hull", v.City))
+		}
+	}
+
+	c.Assert(g.CountryHull("ZZ"), HasLen, 0)
+}
+
+func (s *GeobedSuite) TestCountryByISO(c *C) {
+	co, ok := g.CountryByISO("fr")
+	c.Assert(ok, Equals, true)
+	c.Assert(co.Country, Equals, "France")
+	c.Assert(co.Capital, Equals, "Paris")
+	co, ok = g.CountryByISO("USA")
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "US")
+
+	_, ok = g.CountryByISO("XX")
+	c.Assert(ok, Equals, false)
+	_, ok = g.CountryByISO("")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestCountryByName(c *C) {
+	co, ok := g.CountryByName("france")
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "FR")
+	// With or without diacritics, and other names.
+	co, ok = g.CountryByName("Cote d'Ivoire")
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "CI")
+	co, ok = g.CountryByName("East Timor")
+	c.Assert(ok, Equals, true)
+	c.Assert(co.ISO, Equals, "TL")
+
+	_, ok = g.CountryByName("Atlantis")
+	c.Assert(ok, Equals, false)
+	_, ok = g.CountryByName("")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GeobedSuite) TestConcurrentReload(c *C) {
+	mg := GeoBed{cfg: g.cfg, mu: &sync.RWMutex{}, spatial: newSpatialIndex(), results: newResultCache(10)}
+	c.Assert(mg.reload(), IsNil)
+
+	// Lookups carry on while the data is reloaded (run with -race to check).
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			mg.reload()
+		}
+		close(done)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				mg.Geocode("Austin, TX")
+				mg.ReverseGeocode(30.26715, -97.74306)
+				mg.CitiesByName("Paris")
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+
+	// A hook can look things up itself.
+	mg.cfg.resultHook = func(r *GeobedCity) {
+		r.Region, _, _ = mg.Hierarchy(*r)
+	}
+	c.Assert(mg.Geocode("Austin, TX").Region, Equals, "Texas")
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).Region, Equals, "Texas")
+}
+
+func (s *GeobedSuite) TestUpdate(c *C) {
+	dir := c.MkDir()
+	stale := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for _, f := range dataSetFiles {
+		b, err := ioutil.ReadFile(g.cfg.dataPath(f["path"]))
+		c.Assert(err, IsNil)
+		path := filepath.Join(dir, filepath.Base(f["path"]))
+		c.Assert(ioutil.WriteFile(path, b, 0644), IsNil)
+		c.Assert(os.Chtimes(path, stale, stale), IsNil)
+	}
+
+	lastModified := stale.Add(-time.Hour)
+	// The most downloads at once, more than one means two reloads overlapped.
+	var mu sync.Mutex
+	downloads, inFlight, maxInFlight := 0, 0, 0
+	failing := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filepath.Base(r.URL.Path) == failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		if r.Method == "GET" {
+			mu.Lock()
+			downloads++
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			http.ServeFile(w, r, filepath.Join(g.cfg.dataDir, filepath.Base(r.URL.Path)))
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+	}))
+	defer ts.Close()
+	defer func(f []map[string]string) { dataSetFiles = f }(dataSetFiles)
+	files := []map[string]string{}
+	for _, f := range dataSetFiles {
+		files = append(files, map[string]string{"url": ts.URL + "/" + filepath.Base(f["path"]), "path": f["path"], "id": f["id"]})
+	}
+	dataSetFiles = files
+
+	mg := GeoBed{cfg: newConfig(nil), spatial: newSpatialIndex(), results: newResultCache(10)}
+	mg.cfg.dataDir = dir
+	// Nothing newer.
+	c.Assert(mg.Update(), IsNil)
+	c.Assert(downloads, Equals, 0)
+	c.Assert(mg.c, HasLen, 0)
+
+	// Checking the last data set fails after the others were downloaded. They aren't taken to be current, so the next update loads them.
+	lastModified = stale.Add(time.Hour)
+	failing = "admin1CodesASCII.txt"
+	err := mg.Update()
+	c.Assert(errors.Is(err, ErrDownloadFailed), Equals, true)
+	c.Assert(downloads, Equals, len(files)-1)
+	c.Assert(mg.c, HasLen, 0)
+	changed, _, err := mg.cfg.dataSetChanged(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, true)
+	failing, downloads = "", 0
+
+	c.Assert(mg.Update(), IsNil)
+	c.Assert(downloads, Equals, len(files))
+	c.Assert(len(mg.c), Equals, len(g.c))
+	c.Assert(mg.co, DeepEquals, g.co)
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+	_, err = os.Stat(filepath.Join(dir, "meta.dmp"))
+	c.Assert(err, IsNil)
+	fi, err := os.Stat(filepath.Join(dir, "cities1000.zip"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime().Equal(lastModified), Equals, true)
+
+	// And now it's current.
+	c.Assert(mg.Update(), IsNil)
+	c.Assert(downloads, Equals, len(files))
+	c.Assert(mg.ReloadDataSets(false), IsNil)
+	c.Assert(downloads, Equals, len(files))
+
+	// Unless it's forced.
+	mg.c = nil
+	c.Assert(mg.ReloadDataSets(true), IsNil)
+	c.Assert(downloads, Equals, 2*len(files))
+	c.Assert(len(mg.c), Equals, len(g.c))
+
+	// Reloads at the same time run one after the other, while lookups carry on (run with -race to check).
+	mg.mu, mg.reloadMu = &sync.RWMutex{}, &sync.Mutex{}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Check(mg.ReloadDataSets(true), IsNil)
+		}()
+		go func() {
+			defer wg.Done()
+			mg.Geocode("Austin, TX")
+		}()
+	}
+	wg.Wait()
+	c.Assert(downloads, Equals, 5*len(files))
+	c.Assert(maxInFlight, Equals, 1)
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+	_, err = loadGeobedCityData(os.DirFS(dir), mg.cfg.cacheFormat)
+	c.Assert(err, IsNil)
+}
+
+func (s *GeobedSuite) TestReloadEmptyData(c *C) {
+	dir := c.MkDir()
+	for _, f := range dataSetFiles {
+		b, err := ioutil.ReadFile(g.cfg.dataPath(f["path"]))
+		c.Assert(err, IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, filepath.Base(f["path"])), b, 0644), IsNil)
+	}
+	mg := GeoBed{cfg: g.cfg, mu: &sync.RWMutex{}, spatial: newSpatialIndex(), results: newResultCache(10)}
+	mg.cfg.dataDir = dir
+	c.Assert(mg.reload(), IsNil)
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+
+	// A data set with no cities in it leaves the old data in place.
+	for _, name := range []string{"cities1000.zip", "worldcitiespop.txt.gz"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte("#\n"), 0644), IsNil)
+	}
+	err := mg.reload()
+	c.Assert(errors.Is(err, ErrEmptyData), Equals, true)
+	c.Assert(len(mg.c), Equals, len(g.c))
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+}
+
+func (s *GeobedSuite) TestHierarchy(c *C) {
+	region, country, continent := g.Hierarchy(g.Geocode("Austin, TX"))
+	c.Assert(region, Equals, "Texas")
+	c.Assert(country, Equals, "United States")
+	c.Assert(continent, Equals, "North America")
+
+	paris := g.Geocode("Paris, France")
+	region, country, continent = g.Hierarchy(paris)
+	c.Assert(region, Equals, "Île-de-France")
+	c.Assert(country, Equals, "France")
+	c.Assert(continent, Equals, "Europe")
+
+	region, country, continent = g.Hierarchy(GeobedCity{})
+	c.Assert(region+country+continent, Equals, "")
+}
+
+func (s *GeobedSuite) TestRegionName(c *C) {
+	c.Assert(g.RegionName("US", "TX"), Equals, "Texas")
+	c.Assert(g.RegionName("ca", "08"), Equals, "Ontario")
+	c.Assert(g.RegionName("CH", "ZH"), Equals, "Zurich")
+	// MaxMind's code for the same canton.
+	c.Assert(g.RegionName("CH", "25"), Equals, "Zurich")
+	c.Assert(g.RegionName("FR", "ZZ"), Equals, "ZZ")
+	c.Assert(g.RegionName("", ""), Equals, "")
+
+	// The US states still have names without the data set.
+	mg := GeoBed{}
+	c.Assert(mg.RegionName("US", "48"), Equals, "Texas")
+	c.Assert(mg.RegionName("CA", "08"), Equals, "08")
+}
+
+func (s *GeobedSuite) TestFuzzyMatch(c *C) {
+	c.Assert(levenshtein("pheonix", "phoenix", 2), Equals, 2)
+	c.Assert(levenshtein("chicgo", "chicago", 2), Equals, 1)
+	c.Assert(levenshtein("zürich", "zurich", 2), Equals, 1)
+	c.Assert(levenshtein("austin", "austin", 2), Equals, 0)
+	c.Assert(levenshtein("austin", "houston", 2), Equals, 3)
+	c.Assert(levenshtein("a", "abcdef", 2), Equals, 3)
+
+	mg := g
+	mg.results = nil
+	mg.cfg.fuzzyDistance = 2
+	misspelled := map[string]string{
+		"Pheonix":       "Phoenix",
+		"Pheonix, AZ":   "Phoenix",
+		"Chicgo":        "Chicago",
+		"Philidelphia":  "Philadelphia",
+		"Cincinatti":    "Cincinnati",
+		"Sacremento":    "Sacramento",
+		"Albuquerqe NM": "Albuquerque",
+	}
+	for q, city := range misspelled {
+		c.Assert(mg.Geocode(q).City, Equals, city, Commentf(q))
+	}
+	// Without it, it's anyone's guess.
+	c.Assert(g.Geocode("Chicgo").City, Not(Equals), "Chicago")
+
+	// Names that are spelled right are matched as usual.
+	for _, q := range []string{"Austin, TX", "Chico", "Paris", "New York", "NYC", "Palo Alto"} {
+		c.Assert(mg.Geocode(q), DeepEquals, g.Geocode(q), Commentf(q))
+	}
+}
+
+func (s *GeobedSuite) TestAutocomplete(c *C) {
+	c.Assert(g.Autocomplete("San Fr", 5)[0].City, Equals, "San Francisco")
+	c.Assert(g.Autocomplete("zür", 1)[0].City, Equals, "Zürich")
+	c.Assert(g.Autocomplete("", 5), HasLen, 0)
+	c.Assert(g.Autocomplete("qqqzzz", 5), HasLen, 0)
+
+	cities := g.Autocomplete("san", 0)
+	c.Assert(len(cities) > 3, Equals, true)
+	c.Assert(g.Autocomplete("san", 3), DeepEquals, cities[:3])
+	for k, v := range cities {
+		c.Assert(strings.HasPrefix(v.CityLower, "san"), Equals, true)
+		if k > 0 {
+			c.Assert(v.Population <= cities[k-1].Population, Equals, true)
+		}
+	}
+	// Austin is in both data sets, but only listed once.
+	texas := 0
+	for _, v := range g.Autocomplete("Austin", 0) {
+		if v.CityLower == "austin" && v.Region == "TX" {
+			texas++
+		}
+	}
+	c.Assert(texas, Equals, 1)
+
+	// A finished word doesn't match longer ones.
+	for _, v := range g.Autocomplete("san ", 0) {
+		c.Assert(strings.HasPrefix(v.CityLower, "san "), Equals, true)
+	}
+}
+
+func (s *GeobedSuite) TestMemoryEstimate(c *C) {
+	n := g.MemoryEstimate()
+	c.Assert(n > int64(len(g.c))*int64(unsafe.Sizeof(GeobedCity{})), Equals, true)
+
+	// Fewer fields, less memory.
+	mg := GeoBed{c: make(Cities, len(g.c)), co: g.co, cfg: newConfig([]Option{WithLoadFields(FieldGeohash)})}
+	copy(mg.c, g.c)
+	for k := range mg.c {
+		mg.cfg.trimFields(&mg.c[k])
+	}
+	c.Assert(mg.MemoryEstimate() < n, Equals, true)
+}
+
+func (s *GeobedSuite) TestLoadCountriesOnly(c *C) {
+	co, err := LoadCountriesOnly(g.cfg.dataDir)
+	c.Assert(err, IsNil)
+	c.Assert(co, DeepEquals, g.co)
+
+	// Without a dump, the source file is read.
+	dir := c.MkDir()
+	b, err := ioutil.ReadFile(filepath.Join(g.cfg.dataDir, "countryInfo.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "countryInfo.txt"), b, 0666), IsNil)
+	co, err = LoadCountriesOnly(dir)
+	c.Assert(err, IsNil)
+	c.Assert(co, DeepEquals, g.co)
+
+	_, err = LoadCountriesOnly(c.MkDir())
+	c.Assert(errors.Is(err, ErrDataNotFound), Equals, true)
+}
+
+func (s *GeobedSuite) TestDataDirEnv(c *C) {
+	defer os.Setenv(dataDirEnv, os.Getenv(dataDirEnv))
+
+	os.Setenv(dataDirEnv, "")
+	c.Assert(newConfig(nil).dataDir, Equals, "./geobed-data")
+
+	dir := c.MkDir()
+	os.Setenv(dataDirEnv, dir)
+	cfg := newConfig(nil)
+	c.Assert(cfg.dataDir, Equals, dir)
+	c.Assert(cfg.dataPath("./geobed-data/cities1000.zip"), Equals, filepath.Join(dir, "cities1000.zip"))
+
+	// The option wins over the environment.
+	optDir := c.MkDir()
+	c.Assert(newConfig([]Option{WithDataDir(optDir)}).dataDir, Equals, optDir)
+
+	// PurgeCache() without a directory uses it too.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "meta.dmp"), []byte("x"), 0666), IsNil)
+	c.Assert(PurgeCache(""), IsNil)
+	_, err := os.Stat(filepath.Join(dir, "meta.dmp"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *GeobedSuite) TestNewGeobedErrors(c *C) {
+	defer os.Setenv(dataDirEnv, os.Getenv(dataDirEnv))
+
+	found := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		// Only a comment.
+		w.Write([]byte("#\n"))
+	}))
+	defer ts.Close()
+	defer func(f []map[string]string) { dataSetFiles = f }(dataSetFiles)
+	files := []map[string]string{}
+	for _, f := range dataSetFiles {
+		files = append(files, map[string]string{"url": ts.URL + "/" + filepath.Base(f["path"]), "path": f["path"], "id": f["id"]})
+	}
+	dataSetFiles = files
+
+	// The data sets can't be downloaded.
+	os.Setenv(dataDirEnv, c.MkDir())
+	_, err := NewGeobed()
+	c.Assert(errors.Is(err, ErrDownloadFailed), Equals, true)
+
+	// They can, but there's nothing in them.
+	found = true
+	dir := c.MkDir()
+	os.Setenv(dataDirEnv, dir)
+	_, err = NewGeobed()
+	c.Assert(errors.Is(err, ErrEmptyData), Equals, true)
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, false)
+
+	// And the cache is damaged too.
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "g.c.dmp"), []byte("x"), 0666), IsNil)
+	_, err = NewGeobed()
+	c.Assert(errors.Is(err, ErrEmptyData), Equals, true)
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, true)
+}
+
+func (s *GeobedSuite) TestNewGeobedFromFS(c *C) {
+	fsys := fstest.MapFS{}
+	add := func(names ...string) {
+		for _, name := range names {
+			b, err := ioutil.ReadFile(filepath.Join(g.cfg.dataDir, name))
+			c.Assert(err, IsNil)
+			fsys[name] = &fstest.MapFile{Data: b}
+		}
+	}
+	add("g.c.dmp", "g.co.dmp", "cityNameIdx.dmp")
+	mg, err := NewGeobedFromFS(fsys)
+	c.Assert(err, IsNil)
+	c.Assert(mg.Geocode("Austin, TX").City, Equals, "Austin")
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+	c.Assert(mg.RegionName("CA", "08"), Equals, "08")
+
+	// The rest of the cache is used when it's there.
+	add("meta.dmp", "regionNames.dmp", "spatialIdx.dmp")
+	mg, err = NewGeobedFromFS(fsys, WithLoadFields(FieldGeohash))
+	c.Assert(err, IsNil)
+	c.Assert(mg.RegionName("CA", "08"), Equals, "Ontario")
+	c.Assert(mg.SourceDataDate().Equal(g.SourceDataDate()), Equals, true)
+	c.Assert(mg.ReverseGeocode(30.26715, -97.74306).City, Equals, "Austin")
+	c.Assert(mg.Geocode("Austin, TX").CityAlt, Equals, "")
+
+	delete(fsys, "g.co.dmp")
+	_, err = NewGeobedFromFS(fsys)
+	c.Assert(errors.Is(err, ErrDataNotFound), Equals, true)
+	fsys["g.co.dmp"] = &fstest.MapFile{Data: []byte("garbage")}
+	_, err = NewGeobedFromFS(fsys)
+	c.Assert(errors.Is(err, ErrCacheCorrupt), Equals, true)
+}
+
+func (s *GeobedSuite) TestLoadDataSetsErrors(c *C) {
+	dir := c.MkDir()
+	for _, name := range []string{"cities1000.zip", "countryInfo.txt"} {
+		b, err := ioutil.ReadFile(filepath.Join(g.cfg.dataDir, name))
+		c.Assert(err, IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), b, 0644), IsNil)
+	}
+	// The MaxMind cities and region names are missing, which is fine.
+	mg := GeoBed{cfg: newConfig([]Option{WithDataDir(dir)})}
+	c.Assert(mg.loadDataSets(), IsNil)
+	c.Assert(len(mg.c) > 0, Equals, true)
+
+	// A damaged download is an error rather than the end of the process.
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cities1000.zip"))
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "cities1000.zip"), b[:len(b)/2], 0644), IsNil)
+	mg = GeoBed{cfg: newConfig([]Option{WithDataDir(dir)})}
+	c.Assert(errors.Is(mg.loadDataSets(), ErrInvalidData), Equals, true)
+
+	c.Assert(os.Remove(filepath.Join(dir, "countryInfo.txt")), IsNil)
+	c.Assert(os.Remove(filepath.Join(dir, "cities1000.zip")), IsNil)
+	mg = GeoBed{cfg: newConfig([]Option{WithDataDir(dir)})}
+	c.Assert(errors.Is(mg.loadDataSets(), ErrDataNotFound), Equals, true)
+}
+
+func (s *GeobedSuite) TestDownloadRetries(c *C) {
+	defer func(d time.Duration) { downloadBackoff = d }(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte("Country,City,AccentCity,Region,Population,Latitude,Longitude\n"), 1000))
+	w.Close()
+	// The first downloads are cut off partway, without a Content-Length to tell.
+	cutOff, requests := 2, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing.txt.gz":
+			http.NotFound(w, r)
+		case requests <= cutOff:
+			w.Write(gz.Bytes()[:gz.Len()/2])
+		default:
+			w.Write(gz.Bytes())
+		}
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(c.MkDir(), "worldcitiespop.txt.gz")
+	c.Assert(checkDataFile(path), NotNil)
+	cfg := newConfig(nil)
+	c.Assert(cfg.fetchFile(context.Background(), ts.URL+"/worldcitiespop.txt.gz", path), IsNil)
+	c.Assert(requests, Equals, 3)
+	c.Assert(checkDataFile(path), IsNil)
+
+	// Out of retries, the damaged file isn't left to be loaded.
+	requests = 0
+	cfg = newConfig([]Option{WithDownloadRetries(1)})
+	c.Assert(cfg.fetchFile(context.Background(), ts.URL+"/worldcitiespop.txt.gz", path), NotNil)
+	c.Assert(requests, Equals, 2)
+	_, err := os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// A file that isn't there isn't asked for again.
+	requests = 0
+	c.Assert(cfg.fetchFile(context.Background(), ts.URL+"/missing.txt.gz", path), NotNil)
+	c.Assert(requests, Equals, 1)
+}
+
+func (s *GeobedSuite) TestHTTPClient(c *C) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hung" {
+			<-release
+		}
+		w.Header().Set("Last-Modified", "Mon, 14 Mar 2016 00:00:00 GMT")
+		w.Write([]byte("data"))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// The given client is used for downloads and for checking for updates.
+	used := 0
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		used++
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	cfg := newConfig([]Option{WithHTTPClient(client)})
+	path := filepath.Join(c.MkDir(), "data")
+	c.Assert(cfg.downloadFile(context.Background(), ts.URL+"/data", path), IsNil)
+	_, err := cfg.lastModified(ts.URL + "/data")
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, 2)
+
+	// A download that hangs gives up after the client's timeout, and doesn't leave a partial file behind.
+	cfg = newConfig([]Option{WithHTTPClient(&http.Client{Timeout: 50 * time.Millisecond})})
+	c.Assert(cfg.downloadFile(context.Background(), ts.URL+"/hung", path), NotNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(newConfig(nil).client().Timeout, Equals, 5*time.Minute)
+}
+
+func (s *GeobedSuite) TestProgress(c *C) {
+	data := bytes.Repeat([]byte("x"), 100000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sized.txt" {
+			w.Header().Set("Content-Length", "100000")
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	var file string
+	var calls, done, total int64
+	cfg := newConfig([]Option{WithProgress(func(f string, d int64, t int64) {
+		c.Assert(d > done, Equals, true)
+		file, done, total = f, d, t
+		calls++
+	})})
+	dir := c.MkDir()
+	c.Assert(cfg.downloadFile(context.Background(), ts.URL+"/sized.txt", filepath.Join(dir, "sized.txt")), IsNil)
+	c.Assert(file, Equals, "sized.txt")
+	c.Assert(done, Equals, int64(len(data)))
+	c.Assert(total, Equals, int64(len(data)))
+	c.Assert(calls > 1, Equals, true)
+
+	// Without a Content-Length (chunked), the total isn't known.
+	done = 0
+	c.Assert(cfg.downloadFile(context.Background(), ts.URL+"/chunked.txt", filepath.Join(dir, "chunked.txt")), IsNil)
+	c.Assert(done, Equals, int64(len(data)))
+	c.Assert(total, Equals, int64(-1))
+}
+
+func (s *GeobedSuite) TestDownloadDataSets(c *C) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Part of the file, then nothing until the test is done.
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	defer func(f []map[string]string) { dataSetFiles = f }(dataSetFiles)
+	files := []map[string]string{}
+	for _, f := range dataSetFiles {
+		files = append(files, map[string]string{"url": ts.URL + "/" + filepath.Base(f["path"]), "path": f["path"], "id": f["id"]})
+	}
+	dataSetFiles = files
+
+	dir := c.MkDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	err := DownloadDataSets(ctx, WithDataDir(dir))
+	c.Assert(errors.Is(err, ErrDownloadFailed), Equals, true)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	// Nothing is left behind, and the rest weren't started.
+	left, _ := ioutil.ReadDir(dir)
+	c.Assert(left, HasLen, 0)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 // Benchmark comments from a MacbookPro Retina with 8GB of RAM with who knows what running.
 
 // 5629888699 ns/op
@@ -120,7 +2348,7 @@ func (s *GeobedSuite) TestToLower(c *C) {
 // 5473618388 ns/op
 // This takes about 5 seconds (to load the data sets into memory - should only happen once per application, ideally one would do this up front)
 func BenchmarkNewGeobed(b *testing.B) {
-	g = NewGeobed()
+	g, _ = NewGeobed()
 }
 
 // 2285549904 ns/op
@@ -156,3 +2384,11 @@ func BenchmarkGeocode(b *testing.B) {
 		g.Geocode("New York")
 	}
 }
+
+// Compare with -cpu 1,2,4,8 to see how GeocodeBatch() scales.
+func BenchmarkGeocodeBatch(b *testing.B) {
+	queries := []string{"New York", "Austin, TX", "Paris", "london", "Palo Alto, CA", "Zurich", "sao paulo", "NYC"}
+	for n := 0; n < b.N; n++ {
+		g.GeocodeBatch(queries, runtime.GOMAXPROCS(0))
+	}
+}
@@ -0,0 +1,154 @@
+package geobed
+
+import (
+	geohash "github.com/TomiHiltunen/geohash-golang"
+	"math"
+	"strings"
+)
+
+// The geohash alphabet.
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Returns the geohash for a lat/lng. It's 12 characters long, the same precision used for GeobedCity.Geohash.
+func EncodeGeohash(lat float64, lng float64) string {
+	return geohash.Encode(lat, lng)
+}
+
+// Returns the geohash for a city's coordinates, or "" if it doesn't have any. Rows in the data sets with empty coordinates come out as 0, 0,
+// which isn't anywhere a city could be. A city merely near 0, 0 (ie. in the Gulf of Guinea) is fine.
+func cityGeohash(lat float64, lng float64) string {
+	if (lat == 0 && lng == 0) || checkCoordinate(lat, lng) != nil {
+		return ""
+	}
+	return geohash.Encode(lat, lng)
+}
+
+// Returns the lat/lng at the center of a geohash's cell. An invalid geohash returns 0, 0.
+func DecodeGeohash(hash string) (float64, float64) {
+	hash = toLower(hash)
+	if !validGeohash(hash) {
+		return 0, 0
+	}
+	center := geohash.Decode(hash).Center()
+	return center.Lat(), center.Lng()
+}
+
+// Returns the area a (valid) geohash's cell covers.
+func geohashBox(hash string) BoundingBox {
+	lat, lng := DecodeGeohash(hash)
+	bits := 5 * len(hash)
+	h := 180 / math.Pow(2, float64(bits/2))
+	w := 360 / math.Pow(2, float64((bits+1)/2))
+	return BoundingBox{MinLat: lat - h/2, MinLng: lng - w/2, MaxLat: lat + h/2, MaxLng: lng + w/2}
+}
+
+func validGeohash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if strings.IndexByte(geohashBase32, hash[i]) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup tables for finding adjacent geohash cells, indexed by direction and then by whether the geohash has an even (0) or odd (1) length.
+// See https://github.com/davetroy/geohash-js for where these come from.
+var (
+	geohashNeighborChars = map[byte][2]string{
+		'n': {"p0r21436x8zb9dcf5h7kjnmqesgutwvy", "bc01fg45238967deuvhjyznpkmstqrwx"},
+		's': {"14365h7k9dcfesgujnmqp0r2twvyx8zb", "238967debc01fg45kmstqrwxuvhjyznp"},
+		'e': {"bc01fg45238967deuvhjyznpkmstqrwx", "p0r21436x8zb9dcf5h7kjnmqesgutwvy"},
+		'w': {"238967debc01fg45kmstqrwxuvhjyznp", "14365h7k9dcfesgujnmqp0r2twvyx8zb"},
+	}
+	geohashBorderChars = map[byte][2]string{
+		'n': {"prxz", "bcfguvyz"},
+		's': {"028b", "0145hjnp"},
+		'e': {"bcfguvyz", "prxz"},
+		'w': {"0145hjnp", "028b"},
+	}
+)
+
+// Returns the geohash of the adjacent cell in a direction ('n', 's', 'e' or 'w').
+func adjacentGeohash(hash string, dir byte) string {
+	last := hash[len(hash)-1]
+	parent := hash[:len(hash)-1]
+	t := len(hash) % 2
+	// When the cell is on the border of its parent, the parent's neighbor has to be found first.
+	if strings.IndexByte(geohashBorderChars[dir][t], last) != -1 && parent != "" {
+		parent = adjacentGeohash(parent, dir)
+	}
+	return parent + string(geohashBase32[strings.IndexByte(geohashNeighborChars[dir][t], last)])
+}
+
+// Returns the eight geohashes surrounding a geohash, with the same precision, in the order: north, northeast, east, southeast,
+// south, southwest, west and northwest. Cells wrap around the antimeridian. An invalid geohash returns nil.
+// Reverse geocoding near the edge of a cell should also look at its neighbors since a nearby city can have a very different geohash.
+func GeohashNeighbors(hash string) []string {
+	hash = toLower(hash)
+	if !validGeohash(hash) {
+		return nil
+	}
+	n := adjacentGeohash(hash, 'n')
+	s := adjacentGeohash(hash, 's')
+	return []string{
+		n,
+		adjacentGeohash(n, 'e'),
+		adjacentGeohash(hash, 'e'),
+		adjacentGeohash(s, 'e'),
+		s,
+		adjacentGeohash(s, 'w'),
+		adjacentGeohash(hash, 'w'),
+		adjacentGeohash(n, 'w'),
+	}
+}
+
+// Returns the size (height and width) in kilometers of a geohash cell with the given number of characters at a latitude.
+func geohashCellSizeKm(precision int, lat float64) (float64, float64) {
+	bits := 5 * precision
+	latBits, lngBits := bits/2, (bits+1)/2
+	kmPerDegree := earthRadiusKm * math.Pi / 180
+	h := 180 / math.Pow(2, float64(latBits)) * kmPerDegree
+	w := 360 / math.Pow(2, float64(lngBits)) * kmPerDegree * math.Cos(toRadians(lat))
+	return h, w
+}
+
+// Returns the geohash prefixes that together cover a circle, for querying something else that's indexed by geohash (ie. a database)
+// the same way. The cells are the one the point is in and its neighbors, using the longest prefix where a cell is at least as tall and
+// wide as the radius. When even single character cells are too small, all 32 of them are returned. A bad coordinate returns nil.
+func GeohashCellsForRadius(lat float64, lng float64, radiusKm float64) []string {
+	if checkCoordinate(lat, lng) != nil || math.IsNaN(radiusKm) || radiusKm < 0 {
+		return nil
+	}
+	// Cells are narrowest on the side of the circle nearest a pole.
+	farLat := math.Min(90, math.Abs(lat)+radiusKm/(earthRadiusKm*math.Pi/180))
+
+	precision := 0
+	for p := 1; p <= 12; p++ {
+		h, w := geohashCellSizeKm(p, farLat)
+		if h < radiusKm || w < radiusKm {
+			break
+		}
+		precision = p
+	}
+	if precision == 0 {
+		cells := make([]string, len(geohashBase32))
+		for i := range geohashBase32 {
+			cells[i] = geohashBase32[i : i+1]
+		}
+		return cells
+	}
+
+	center := EncodeGeohash(lat, lng)[:precision]
+	cells := []string{center}
+	seen := map[string]bool{center: true}
+	for _, n := range GeohashNeighbors(center) {
+		if !seen[n] {
+			seen[n] = true
+			cells = append(cells, n)
+		}
+	}
+	return cells
+}
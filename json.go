@@ -0,0 +1,84 @@
+package geobed
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Writes the cities to w as a JSON array, one city at a time, so a large result set (ie. every city in a country) can be streamed to
+// an HTTP response without building the whole document in memory first.
+func WriteCitiesJSON(w io.Writer, cities []GeobedCity) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for k := range cities {
+		if k > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(&cities[k]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// A GeoJSON Feature, see GeoJSON().
+type geoJSONFeature struct {
+	Type       string       `json:"type"`
+	Geometry   geoJSONPoint `json:"geometry"`
+	Properties GeobedCity   `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type string `json:"type"`
+	// Longitude first, as RFC 7946 has it.
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Returns the city as a GeoJSON (RFC 7946) Feature with a Point geometry and the city's fields as its properties, which map libraries
+// like Leaflet and Mapbox can show as is (ie. a ReverseGeocode() result sent straight to the browser).
+func (c GeobedCity) GeoJSON() ([]byte, error) {
+	return json.Marshal(geoJSONFeature{
+		Type:       "Feature",
+		Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{c.Longitude, c.Latitude}},
+		Properties: c,
+	})
+}
+
+// A schema.org Place as JSON-LD, see SchemaOrgPlace().
+type schemaOrgPlace struct {
+	Context string                 `json:"@context"`
+	Type    string                 `json:"@type"`
+	Name    string                 `json:"name,omitempty"`
+	Geo     schemaOrgGeo           `json:"geo"`
+	Address schemaOrgPostalAddress `json:"address"`
+}
+
+type schemaOrgGeo struct {
+	Type      string  `json:"@type"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type schemaOrgPostalAddress struct {
+	Type            string `json:"@type"`
+	AddressLocality string `json:"addressLocality,omitempty"`
+	AddressRegion   string `json:"addressRegion,omitempty"`
+	AddressCountry  string `json:"addressCountry,omitempty"`
+}
+
+// Returns the city as a schema.org Place in JSON-LD, for embedding in a web page as structured data. The country is its ISO code,
+// which schema.org accepts for addressCountry.
+func (c GeobedCity) SchemaOrgPlace() ([]byte, error) {
+	return json.Marshal(schemaOrgPlace{
+		Context: "https://schema.org",
+		Type:    "Place",
+		Name:    c.City,
+		Geo:     schemaOrgGeo{Type: "GeoCoordinates", Latitude: c.Latitude, Longitude: c.Longitude},
+		Address: schemaOrgPostalAddress{Type: "PostalAddress", AddressLocality: c.City, AddressRegion: c.Region, AddressCountry: c.Country},
+	})
+}
@@ -0,0 +1,57 @@
+package geobed
+
+import "unsafe"
+
+// A rough guess at what each map entry costs on top of its key and value (hash buckets, load factor, etc.).
+const mapEntryOverhead = 16
+
+// Returns roughly how many bytes of memory the loaded data and its indexes take. It's worked out from the number of cities and countries,
+// the size of the structs and the length of their strings rather than measured, so it's only an estimate. Useful for comparing the data
+// sets or options (ie. WithLoadFields()) without profiling.
+func (g *GeoBed) MemoryEstimate() int64 {
+	defer g.rlock()()
+	var n int64
+	n += int64(cap(g.c)) * int64(unsafe.Sizeof(GeobedCity{}))
+	for _, c := range g.c {
+		n += int64(len(c.City) + len(c.CityLower) + len(c.CityAlt) + len(c.Country) + len(c.Region) + len(c.Geohash) + len(c.FeatureCode) + len(c.Timezone))
+	}
+	n += int64(cap(g.co)) * int64(unsafe.Sizeof(CountryInfo{}))
+	for _, co := range g.co {
+		n += int64(len(co.Country) + len(co.Capital) + len(co.ISO) + len(co.ISO3) + len(co.Fips) + len(co.Continent) + len(co.Tld) +
+			len(co.CurrencyCode) + len(co.CurrencyName) + len(co.Phone) + len(co.PostalCodeFormat) + len(co.PostalCodeRegex) +
+			len(co.Languages) + len(co.Neighbours) + len(co.EquivalentFipsCode))
+	}
+
+	const str, num = int64(unsafe.Sizeof("")), int64(unsafe.Sizeof(0))
+	for k := range g.cityNameIdx {
+		n += int64(len(k)) + str + num + mapEntryOverhead
+	}
+	for k, v := range g.altNameIdx {
+		n += int64(len(k)) + str + int64(unsafe.Sizeof(v)) + int64(cap(v))*num + mapEntryOverhead
+	}
+	for k := range g.countryBoundsIdx {
+		n += int64(len(k)) + str + int64(unsafe.Sizeof(countryBounds{})) + mapEntryOverhead
+	}
+	for k := range g.countryCapitalIdx {
+		n += int64(len(k)) + str + num + mapEntryOverhead
+	}
+	for k := range g.regionLargestIdx {
+		n += int64(len(k)) + str + num + mapEntryOverhead
+	}
+	for k := range g.countryIdx {
+		n += int64(len(k)) + str + num + mapEntryOverhead
+	}
+	for k := range g.countryNameIdx {
+		n += int64(len(k)) + str + num + mapEntryOverhead
+	}
+	for k, v := range g.regionNames {
+		n += int64(len(k)+len(v)) + 2*str + mapEntryOverhead
+	}
+	// Only once it's been built by reverse geocoding.
+	if g.spatial != nil && g.spatial.idx != nil {
+		for k, v := range g.spatial.idx {
+			n += int64(len(k)) + str + int64(unsafe.Sizeof(v)) + int64(cap(v))*num + mapEntryOverhead
+		}
+	}
+	return n
+}
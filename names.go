@@ -0,0 +1,206 @@
+package geobed
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Sorts cities by population, largest first.
+type byPopulation []GeobedCity
+
+func (c byPopulation) Len() int {
+	return len(c)
+}
+func (c byPopulation) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+func (c byPopulation) Less(i, j int) bool {
+	return c[i].Population > c[j].Population
+}
+
+// Well-known former names of cities. Geonames has them among the alternate names (so they match), but without saying they're historic
+// outside of its separate alternate names file. Keyed by lowercase ASCII name.
+var historicNames = map[string]bool{
+	"bombay":         true,
+	"calcutta":       true,
+	"madras":         true,
+	"peking":         true,
+	"canton":         true,
+	"constantinople": true,
+	"byzantium":      true,
+	"leningrad":      true,
+	"petrograd":      true,
+	"stalingrad":     true,
+	"saigon":         true,
+	"rangoon":        true,
+	"batavia":        true,
+	"edo":            true,
+	"new amsterdam":  true,
+	"leopoldville":   true,
+	"lutetia":        true,
+	"londinium":      true,
+	"eboracum":       true,
+	"christiania":    true,
+}
+
+// Returns the limit most populous cities, largest first, for queries that can match a huge number of cities (ie. everything in a map's viewport).
+// A limit of 0 (or less) keeps all of the cities. The given slice is sorted in place.
+func largestCities(cities []GeobedCity, limit int) []GeobedCity {
+	sort.Stable(byPopulation(cities))
+	if limit > 0 && len(cities) > limit {
+		cities = cities[:limit]
+	}
+	return cities
+}
+
+// Returns every city in the world with the given name (case insensitive and with or without diacritics), largest population first.
+// Unlike Geocode(), which picks one, this shows all of the candidates. ie. all of the Springfields. Alternate names are not considered.
+func (g *GeoBed) CitiesByName(name string) []GeobedCity {
+	defer g.rlock()()
+	return g.citiesByName(name)
+}
+
+func (g *GeoBed) citiesByName(name string) []GeobedCity {
+	name = cleanQuery(name)
+	matches := []GeobedCity{}
+	if name == "" {
+		return matches
+	}
+	folded := g.cfg.fold(name)
+	for _, rng := range g.getSearchRange([]string{folded}) {
+		for _, v := range g.c[rng.f:rng.t] {
+			if v.nameIs(name, folded) {
+				matches = append(matches, v)
+			}
+		}
+	}
+	return largestCities(matches, 0)
+}
+
+// Returns the cities whose names start with a prefix (ie. "San Fr" for San Francisco), largest population first, for a search box's typeahead.
+// Case insensitive and with or without diacritics. A city listed by both data sets is only returned once. At most limit cities are returned,
+// all of them if it's 0 (or less). Alternate names are not considered.
+func (g *GeoBed) Autocomplete(prefix string, limit int) []GeobedCity {
+	defer g.rlock()()
+	matches := []GeobedCity{}
+	p := g.cfg.fold(cleanQuery(prefix))
+	if p == "" {
+		return matches
+	}
+	// A finished word (ie. "San ") shouldn't match longer ones ("Sandy").
+	if strings.TrimRightFunc(prefix, unicode.IsSpace) != prefix {
+		p += " "
+	}
+	// The cities are sorted by their lowercase names, so the ones starting with the prefix are all together.
+	for k := sort.Search(len(g.c), func(i int) bool { return g.c[i].CityLower >= p }); k < len(g.c) && strings.HasPrefix(g.c[k].CityLower, p); k++ {
+		matches = append(matches, g.c[k])
+	}
+	matches = largestCities(matches, 0)
+
+	cities := []GeobedCity{}
+	for _, c := range matches {
+		if limit > 0 && len(cities) == limit {
+			break
+		}
+		dupe := false
+		for _, o := range cities {
+			if o.CityLower == c.CityLower && o.Country == c.Country && strings.EqualFold(o.Region, c.Region) &&
+				Distance(c.Latitude, c.Longitude, o.Latitude, o.Longitude) <= sameCityKm {
+				dupe = true
+				break
+			}
+		}
+		if !dupe {
+			cities = append(cities, c)
+		}
+	}
+	return cities
+}
+
+// Returns all of the known alternate and localized names for a city (ie. one returned by Geocode()), without duplicates or the city's own name.
+// Empty if alternate names weren't loaded (see FieldCityAlt).
+func (g *GeoBed) AliasesFor(c GeobedCity) []string {
+	alt := c.CityAlt
+	if alt == "" {
+		unlock := g.rlock()
+		alt = g.findCity(c).CityAlt
+		unlock()
+	}
+	aliases := []string{}
+	seen := map[string]bool{toLower(c.City): true}
+	for _, a := range strings.Split(alt, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" || seen[toLower(a)] {
+			continue
+		}
+		seen[toLower(a)] = true
+		aliases = append(aliases, a)
+	}
+	return aliases
+}
+
+// Finds the loaded city that a (possibly copied or trimmed down) GeobedCity refers to. Returns an empty GeobedCity if it isn't loaded.
+func (g *GeoBed) findCity(c GeobedCity) GeobedCity {
+	lower := c.CityLower
+	if lower == "" {
+		lower = g.cfg.fold(c.City)
+	}
+	for _, rng := range g.getSearchRange([]string{lower}) {
+		for _, v := range g.c[rng.f:rng.t] {
+			if v.City == c.City && v.Country == c.Country && v.Region == c.Region && v.Latitude == c.Latitude && v.Longitude == c.Longitude {
+				return v
+			}
+		}
+	}
+	return GeobedCity{}
+}
+
+// How close (in kilometers) two cities with the same name have to be to be the same city listed twice (ie. by both Geonames and MaxMind).
+const sameCityKm = 10.0
+
+// Whether two location strings refer to the same city, ie. "NYC", "New York" and "New York, NY". Both are geocoded and the cities compared.
+// The data sets overlap, so the same city can be there twice with slightly different coordinates or with one's name an alternate name of the
+// other. False if either isn't a city (ie. a whole country) or can't be geocoded.
+func (g *GeoBed) SameCity(a string, b string) bool {
+	ca, cb := g.Geocode(a), g.Geocode(b)
+	if ca.City == "" || cb.City == "" || ca.MatchLevel != MatchCity || cb.MatchLevel != MatchCity {
+		return false
+	}
+	if ca.Country != cb.Country || !strings.EqualFold(ca.Region, cb.Region) {
+		return false
+	}
+	if ca.City == cb.City && ca.Latitude == cb.Latitude && ca.Longitude == cb.Longitude {
+		return true
+	}
+	named := ca.CityLower == cb.CityLower || g.hasAlias(ca, cb.City) || g.hasAlias(cb, ca.City)
+	return named && Distance(ca.Latitude, ca.Longitude, cb.Latitude, cb.Longitude) <= sameCityKm
+}
+
+// How close (in kilometers) the nearest cities to two points can be and still be taken as the same place. The data sets list some cities
+// twice, a little apart, and a point near the edge of a city can be nearer to the other listing.
+const sameCityJitterKm = 2.0
+
+// Whether two points are in the same city (going by the nearest city to each), ie. whether a trip started and ended in the same place.
+// False if either point isn't near a city or isn't a valid coordinate.
+func (g *GeoBed) SameCityLatLng(lat1 float64, lng1 float64, lat2 float64, lng2 float64) bool {
+	ca, cb := g.ReverseGeocode(lat1, lng1), g.ReverseGeocode(lat2, lng2)
+	if ca.City == "" || cb.City == "" {
+		return false
+	}
+	d := Distance(ca.Latitude, ca.Longitude, cb.Latitude, cb.Longitude)
+	if ca.CityLower == cb.CityLower && ca.Country == cb.Country && strings.EqualFold(ca.Region, cb.Region) && d <= sameCityKm {
+		return true
+	}
+	return d <= sameCityJitterKm
+}
+
+// Whether a name is one of a city's alternate names.
+func (g *GeoBed) hasAlias(c GeobedCity, name string) bool {
+	for _, a := range g.AliasesFor(c) {
+		if strings.EqualFold(a, name) || g.cfg.fold(a) == g.cfg.fold(name) {
+			return true
+		}
+	}
+	return false
+}
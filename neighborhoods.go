@@ -0,0 +1,85 @@
+package geobed
+
+import "strings"
+
+// The city a neighborhood or borough belongs to.
+type neighborhood struct {
+	city    string
+	country string
+	region  string
+}
+
+// Well-known neighborhoods and boroughs that people give as their location instead of the city (ie. "Brooklyn"), keyed by their lowercase ASCII names.
+var neighborhoods = map[string]neighborhood{
+	// New York City
+	"brooklyn":      {"New York City", "US", "NY"},
+	"manhattan":     {"New York City", "US", "NY"},
+	"queens":        {"New York City", "US", "NY"},
+	"bronx":         {"New York City", "US", "NY"},
+	"the bronx":     {"New York City", "US", "NY"},
+	"staten island": {"New York City", "US", "NY"},
+	"harlem":        {"New York City", "US", "NY"},
+	// Los Angeles
+	"hollywood":    {"Los Angeles", "US", "CA"},
+	"venice beach": {"Los Angeles", "US", "CA"},
+	// Chicago
+	"wicker park": {"Chicago", "US", "IL"},
+	// San Francisco
+	"mission district": {"San Francisco", "US", "CA"},
+	// Boston
+	"back bay": {"Boston", "US", "MA"},
+	// London
+	"westminster":  {"London", "GB", "ENG"},
+	"hackney":      {"London", "GB", "ENG"},
+	"islington":    {"London", "GB", "ENG"},
+	"shoreditch":   {"London", "GB", "ENG"},
+	"brixton":      {"London", "GB", "ENG"},
+	"southwark":    {"London", "GB", "ENG"},
+	"kensington":   {"London", "GB", "ENG"},
+	"notting hill": {"London", "GB", "ENG"},
+	"soho":         {"London", "GB", "ENG"},
+	// Tokyo
+	"shibuya":  {"Tokyo", "JP", "40"},
+	"shinjuku": {"Tokyo", "JP", "40"},
+}
+
+// How close (in kilometers) a city with a neighborhood's name has to be to the parent city to be considered the neighborhood itself.
+const neighborhoodRadiusKm = 50.0
+
+// When a query names a well-known neighborhood or borough (ie. "Brooklyn" or "Brooklyn, NY"), returns the city it belongs to.
+// Not if the query's state or country rule out the parent city (ie. "Brooklyn, MI") or another city with the same name is big enough
+// to be what's meant (ie. "Hollywood, FL"). Turned off with WithNeighborhoods(false).
+func (g *GeoBed) neighborhoodMatch(n string) (GeobedCity, bool) {
+	if !g.cfg.neighborhoods {
+		return GeobedCity{}, false
+	}
+	nCo, nSt, _, nSlice := g.extractLocationPieces(n)
+	name := strings.TrimSuffix(strings.Join(nSlice, " "), ",")
+	nb, ok := neighborhoods[foldLower(name)]
+	if !ok || (nSt != "" && nSt != nb.region) || (nCo != "" && nCo != nb.country) {
+		return GeobedCity{}, false
+	}
+
+	parent := GeobedCity{}
+	for _, c := range g.citiesByName(nb.city) {
+		if c.Country == nb.country && c.Region == nb.region {
+			parent = c
+			break
+		}
+	}
+	if parent.City == "" {
+		return GeobedCity{}, false
+	}
+
+	// Without a state, a big city elsewhere with the same name is just as likely.
+	if nSt == "" {
+		for _, c := range g.citiesByName(name) {
+			if c.Population >= 100000 && Distance(c.Latitude, c.Longitude, parent.Latitude, parent.Longitude) > neighborhoodRadiusKm {
+				return GeobedCity{}, false
+			}
+		}
+	}
+
+	parent.MatchedAlias = name
+	return parent, true
+}
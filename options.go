@@ -0,0 +1,504 @@
+package geobed
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Optional GeobedCity fields to populate when loading the data sets (a bitmask). Skipping fields that an application doesn't use
+// reduces the memory used per city as well as the size of the cached data dump. City, Country, Region, Latitude and Longitude are always loaded.
+type LoadFields uint8
+
+const (
+	// Alternate city names. Geocode() uses these to match other names and spellings of a city (ie. "NYC"). They're also indexed, which takes
+	// a fair bit of additional memory. Not needed for reverse geocoding.
+	FieldCityAlt LoadFields = 1 << iota
+	// The city's geohash. Required by ReverseGeocode(), which returns an empty GeobedCity without it. Not needed for forward geocoding.
+	FieldGeohash
+	// The city's population. Geocode() and ReverseGeocode() use it to favor larger cities when guessing between matches.
+	FieldPopulation
+	// The city's Geonames feature code. Required by ReverseGeocodeByFeature().
+	FieldFeatureCode
+	// The city's time zone.
+	FieldTimezone
+	// The city's elevation. Not loaded by default, see WithExtendedFields().
+	FieldElevation
+
+	// All of the optional fields loaded by default.
+	AllFields = FieldCityAlt | FieldGeohash | FieldPopulation | FieldFeatureCode | FieldTimezone
+	// The fields that are only loaded when asked for, since few applications need them.
+	ExtendedFields = FieldElevation
+)
+
+// How to choose between candidate cities that match a query equally well.
+type TieBreak uint8
+
+const (
+	// The city with the larger population wins (the default). ie. "New York" is New York, NY rather than one of the smaller New Yorks.
+	TieBreakPopulation TieBreak = iota
+	// The city that comes first alphabetically (by name, then country and region). Predictable when population data isn't reliable.
+	TieBreakAlphabetical
+	// The city that was loaded first, so Geonames cities win over MaxMind cities of the same name and otherwise the order of the source file is kept.
+	TieBreakSourcePriority
+)
+
+// Settings used when creating a new Geobed. These are set with the Option functions passed to NewGeobedWithOptions().
+type config struct {
+	fields        LoadFields
+	cacheFormat   CacheFormat
+	foldNames     bool
+	tieBreak      TieBreak
+	dataDir       string
+	cityNames     CityNameRules
+	neighborhoods bool
+	// Each stopword phrase split into its lowercase words.
+	stopwords       [][]string
+	regionCrosswalk bool
+	dataArchive     string
+	resultHook      ResultHook
+	workers         int
+	bounds          *BoundingBox
+	cacheSize       int
+	normalize       func(string) string
+	httpClient      *http.Client
+	progress        ProgressFunc
+	downloadRetries int
+	minPopulation   int32
+	// Whether cities with no population (unknown, most of the MaxMind ones) are loaded despite minPopulation.
+	keepUnknownPopulation bool
+	// The sources of cities to load, lowercase and sorted. All of them when it's empty.
+	sources []string
+	// The furthest (in edits) a misspelled city name can be from the query, 0 to not look for misspellings.
+	fuzzyDistance int
+}
+
+// An Option configures how a Geobed is created and loaded.
+type Option func(*config)
+
+// Sets the directory the data sets are downloaded to and cached in, ie. WithDataDir("/var/lib/geobed"). It takes precedence over
+// $GEOBED_DATA_DIR, and without either it's "./geobed-data". The directory can be read-only if the data sets and cache are already in it.
+func WithDataDir(dir string) Option {
+	return func(cfg *config) {
+		cfg.dataDir = dir
+	}
+}
+
+// Loads the extended fields (see ExtendedFields) on top of the others, ie. the elevation of each city for terrain aware routing. They're
+// only known for Geonames cities. Pass it after any WithLoadFields(), or include the fields in that instead.
+func WithExtendedFields() Option {
+	return func(cfg *config) {
+		cfg.fields |= ExtendedFields
+	}
+}
+
+// Sets which optional fields are loaded for each city. For example, a forward geocode only application can
+// use WithLoadFields(FieldCityAlt | FieldPopulation) to drop geohashes.
+func WithLoadFields(f LoadFields) Option {
+	return func(cfg *config) {
+		cfg.fields = f
+	}
+}
+
+// Sets the format the city and country data is cached in (CacheGob by default). CacheBinary is useful for sharing a prebuilt cache
+// with services that aren't written in Go or that use a different version of this package.
+func WithCacheFormat(f CacheFormat) Option {
+	return func(cfg *config) {
+		cfg.cacheFormat = f
+	}
+}
+
+// Sets how Geocode() and ReverseGeocode() choose between cities that tie (TieBreakPopulation by default).
+func WithTieBreak(t TieBreak) Option {
+	return func(cfg *config) {
+		cfg.tieBreak = t
+	}
+}
+
+// Sets whether city names and alternate names with diacritics are also indexed by their plain ASCII form (on by default), so that
+// "Zurich" and "Zürich" or "Dusseldorf" and "Düsseldorf" find the same city. Turning it off saves a little memory.
+func WithAccentFolding(on bool) Option {
+	return func(cfg *config) {
+		cfg.foldNames = on
+	}
+}
+
+// Sets the function that normalizes names for matching, in place of the default lowercasing and diacritic folding (see WithAccentFolding()).
+// It's used on both the city names as they're loaded (for GeobedCity.CityLower, in place of the data sets' ASCII names) and the queries,
+// so it can handle locale specific spellings the default doesn't (ie. the Turkish dotless i). It should lowercase. The cache is rebuilt
+// when a normalizer is set or removed, but not when one function is swapped for another, so use PurgeCache() after changing it.
+func WithNormalize(fn func(string) string) Option {
+	return func(cfg *config) {
+		cfg.normalize = fn
+	}
+}
+
+// Normalizes a name for matching against GeobedCity.CityLower, with the function set by WithNormalize() or foldLower() by default.
+func (cfg config) fold(s string) string {
+	if cfg.normalize != nil {
+		return cfg.normalize(s)
+	}
+	return foldLower(s)
+}
+
+// Returns GeobedCity.CityLower for a city as it's loaded, from its (cleaned up) name and the data set's ASCII name for it. With
+// WithNormalize() it's the name normalized the same way queries are, so the sorted names and the search ranges agree with them. Otherwise
+// it's the ASCII name (see asciiName()), or the folded name when there isn't one.
+func (cfg config) cityLower(name string, ascii string) string {
+	if cfg.normalize != nil {
+		return cfg.normalize(name)
+	}
+	if lower, _ := cfg.cleanCityName(asciiName(ascii)); lower != "" {
+		return lower
+	}
+	return cfg.fold(name)
+}
+
+// Folds each of the pieces of a query (with any trailing comma removed).
+func (cfg config) foldSlice(nSlice []string) []string {
+	f := make([]string, len(nSlice))
+	for k, ns := range nSlice {
+		f[k] = cfg.fold(strings.TrimSuffix(ns, ","))
+	}
+	return f
+}
+
+// Sets the rules for cleaning up city names as the data sets are loaded (DefaultCityNameRules by default). The cache isn't rebuilt
+// when the rules change, so use PurgeCache() after changing them.
+func WithCityNameRules(r CityNameRules) Option {
+	return func(cfg *config) {
+		cfg.cityNames = r
+	}
+}
+
+// Sets whether Geocode() matches well-known neighborhoods and boroughs to the city they're in (on by default), ie. "Brooklyn" to New York City.
+func WithNeighborhoods(on bool) Option {
+	return func(cfg *config) {
+		cfg.neighborhoods = on
+	}
+}
+
+// Sets the filler words and phrases removed from queries before matching (DefaultStopwords by default), ie. "living in" or "from".
+// To add to the defaults, pass them along with yours: WithStopwords(append(DefaultStopwords, "hometown")). No stopwords turns it off.
+func WithStopwords(words []string) Option {
+	return func(cfg *config) {
+		cfg.stopwords = splitStopwords(words)
+	}
+}
+
+func splitStopwords(words []string) [][]string {
+	split := make([][]string, 0, len(words))
+	for _, w := range words {
+		f := []string{}
+		for _, sw := range strings.Fields(toLower(w)) {
+			if sw = strings.Trim(sw, ",.:"); sw != "" {
+				f = append(f, sw)
+			}
+		}
+		if len(f) > 0 {
+			split = append(split, f)
+		}
+	}
+	return split
+}
+
+// Sets whether MaxMind cities have their region codes changed to the Geonames admin1 codes (off by default), so a city's Region
+// is the same whichever data set it came from. See RegionCrosswalk.
+func WithRegionCrosswalk(on bool) Option {
+	return func(cfg *config) {
+		cfg.regionCrosswalk = on
+	}
+}
+
+// An area on the map. When it crosses the antimeridian, MinLng is greater than MaxLng (ie. 170 to -170).
+type BoundingBox struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+// Whether a point is within the box.
+func (b BoundingBox) contains(lat float64, lng float64) bool {
+	return countryBounds{minLat: b.MinLat, minLng: b.MinLng, maxLat: b.MaxLat, maxLng: b.MaxLng}.contains(lat, lng)
+}
+
+// The box's longitudes as one range, or two when it crosses the antimeridian (one on each side of it).
+func (b BoundingBox) lngRanges() [][2]float64 {
+	if b.MinLng > b.MaxLng {
+		return [][2]float64{{b.MinLng, 180}, {-180, b.MaxLng}}
+	}
+	return [][2]float64{{b.MinLng, b.MaxLng}}
+}
+
+// Whether the box overlaps another one, which doesn't cross the antimeridian (ie. a geohash cell).
+func (b BoundingBox) overlaps(o BoundingBox) bool {
+	if o.MaxLat < b.MinLat || o.MinLat > b.MaxLat {
+		return false
+	}
+	for _, r := range b.lngRanges() {
+		if o.MaxLng >= r[0] && o.MinLng <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Only loads the cities within a bounding box, ie. just Europe for a regional app. Cities outside of it are skipped as the data sets are
+// read, so the full data is never held in memory, and the cache only has what's in the box. Countries are all loaded regardless.
+func WithBoundingBox(b BoundingBox) Option {
+	return func(cfg *config) {
+		cfg.bounds = &b
+	}
+}
+
+// Only loads the cities with at least n people, ie. WithMinPopulation(100000) for an app that only deals with major cities. Cities with no
+// population (which is most of the MaxMind ones, their population isn't known) are skipped too, unless WithKeepUnknownPopulation(true) is
+// also given. Like WithBoundingBox(), the smaller cities are never held in memory or cached, which makes the data a lot smaller and every
+// search faster.
+func WithMinPopulation(n int32) Option {
+	return func(cfg *config) {
+		cfg.minPopulation = n
+	}
+}
+
+// Sets whether cities with no population are loaded even though they're under the minimum set by WithMinPopulation() (they aren't by default).
+func WithKeepUnknownPopulation(keep bool) Option {
+	return func(cfg *config) {
+		cfg.keepUnknownPopulation = keep
+	}
+}
+
+// Whether a city with the population should be loaded.
+func (cfg config) bigEnough(pop int32) bool {
+	return pop >= cfg.minPopulation || (pop <= 0 && cfg.keepUnknownPopulation)
+}
+
+// The sources of cities that can be chosen with WithDataSources().
+const (
+	// Geonames cities with a population of 1,000 or more, with alternate names, time zones and such.
+	SourceGeonames = "geonames"
+	// MaxMind's world cities, many more of them but with less detail (and mostly without a population).
+	SourceMaxMind = "maxmind"
+)
+
+// Only loads the cities from the given sources, ie. WithDataSources(SourceGeonames) for just the Geonames cities (richer details, fewer
+// duplicates) or WithDataSources(SourceMaxMind) for just MaxMind's (more of them). Both are loaded by default. The country and region data
+// comes from Geonames and is loaded either way. Data sets of sources that aren't loaded aren't downloaded either.
+func WithDataSources(sources ...string) Option {
+	return func(cfg *config) {
+		cfg.sources = nil
+		seen := map[string]bool{}
+		for _, s := range sources {
+			s = toLower(strings.TrimSpace(s))
+			if s != "" && !seen[s] {
+				seen[s] = true
+				cfg.sources = append(cfg.sources, s)
+			}
+		}
+		sort.Strings(cfg.sources)
+	}
+}
+
+// Returns the data sets to download and load, only those of the sources chosen with WithDataSources() (and the country and region data).
+func (cfg config) dataSets() []map[string]string {
+	if len(cfg.sources) == 0 {
+		return dataSetFiles
+	}
+	sets := []map[string]string{}
+	for _, f := range dataSetFiles {
+		if supportDataSets[f["id"]] {
+			sets = append(sets, f)
+			continue
+		}
+		// Data set ids start with their source, ie. "geonamesCities1000".
+		for _, s := range cfg.sources {
+			if strings.HasPrefix(f["id"], s) {
+				sets = append(sets, f)
+				break
+			}
+		}
+	}
+	return sets
+}
+
+// Whether a city at the point should be loaded.
+func (cfg config) inBounds(lat float64, lng float64) bool {
+	return cfg.bounds == nil || cfg.bounds.contains(lat, lng)
+}
+
+// Loads the data sets from a single tar archive (which can be gzipped) instead of the separate files, for mirrors that bundle them together.
+// The location is a path or an http(s) URL, which is downloaded into the data directory. Files in the archive are matched to data sets by
+// name, ie. "cities1000.zip" or "cities1000.txt", "countryInfo.txt" and "worldcitiespop.txt.gz". Any data set not in it is read as usual.
+func WithDataArchive(location string) Option {
+	return func(cfg *config) {
+		cfg.dataArchive = location
+	}
+}
+
+// Has Geocode() look for misspelled city names (ie. "Pheonix" or "Chicgo") when no city has a name in the query, allowing up to maxDistance
+// single letter changes (the Levenshtein distance). 1 or 2 is about right, more finds cities that only look a little alike. It's only a
+// fallback, queries that name a city are matched as usual and don't take any longer. The first letter has to be right.
+func WithFuzzyMatch(maxDistance int) Option {
+	return func(cfg *config) {
+		cfg.fuzzyDistance = maxDistance
+	}
+}
+
+// Sets the HTTP client the data sets are downloaded with (and Update() checks for newer ones with), ie. one with a proxy, TLS settings
+// or a different timeout. By default it's a client that gives up on a download after 5 minutes, so a hung connection can't block startup forever.
+func WithHTTPClient(client *http.Client) Option {
+	return func(cfg *config) {
+		cfg.httpClient = client
+	}
+}
+
+// Called as a data set downloads with the name of its file, the bytes downloaded so far and the size of the file (-1 if the server didn't say).
+type ProgressFunc func(file string, bytesDone int64, bytesTotal int64)
+
+// Sets a function that's called after each chunk of a data set is downloaded, ie. to show a progress bar while a CLI tool sets up.
+// The data sets are downloaded one after another, so it isn't called from more than one goroutine at a time.
+func WithProgress(fn ProgressFunc) Option {
+	return func(cfg *config) {
+		cfg.progress = fn
+	}
+}
+
+// Sets how many more times a data set is downloaded when the download fails or the file turns out to be damaged (ie. a truncated gzip),
+// waiting a little longer each time. It's 2 by default, 0 gives up after the first attempt.
+func WithDownloadRetries(n int) Option {
+	return func(cfg *config) {
+		cfg.downloadRetries = n
+	}
+}
+
+// Used when no client was set with WithHTTPClient(). The data sets take a minute or two on a slow link.
+var defaultHTTPClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Returns the HTTP client to download with.
+func (cfg config) client() *http.Client {
+	if cfg.httpClient != nil {
+		return cfg.httpClient
+	}
+	return defaultHTTPClient
+}
+
+// A function that can change or add to a result (ie. fill in a display name) before Geocode() or ReverseGeocode() returns it.
+type ResultHook func(c *GeobedCity)
+
+// Sets a hook that's called with every city found by Geocode() and ReverseGeocode() (and the functions built on them) before it's returned.
+// It's not called when nothing was found. The hook can be called from several goroutines at once (ie. by GeocodeBatch()).
+func WithResultHook(h ResultHook) Option {
+	return func(cfg *config) {
+		cfg.resultHook = h
+	}
+}
+
+// Runs the result hook, if there is one, on a found city.
+func (cfg config) hookResult(c *GeobedCity) {
+	if cfg.resultHook != nil && c.City != "" {
+		cfg.resultHook(c)
+	}
+}
+
+// Sets how many goroutines GeocodeBatch(), ReverseGeocodeBatch() and GeocodeFileResumable() use when a call doesn't say.
+// The default (or 0) is the number of CPUs, which in a container with a CPU limit can be a lot more than it's allowed to use.
+func WithWorkers(n int) Option {
+	return func(cfg *config) {
+		cfg.workers = n
+	}
+}
+
+// Caches the results of up to n Geocode() queries (none by default), dropping the least recently used ones when it's full. Services that
+// see the same location strings over and over (ie. "NYC" in a lot of profiles) skip the matching for repeats. Results are cached before
+// the result hook, which still runs for each call.
+func WithCacheSize(n int) Option {
+	return func(cfg *config) {
+		cfg.cacheSize = n
+	}
+}
+
+// Returns the default configuration with the given options applied.
+func newConfig(opts []Option) config {
+	cfg := config{fields: AllFields, foldNames: true, cityNames: DefaultCityNameRules, neighborhoods: true, stopwords: splitStopwords(DefaultStopwords),
+		downloadRetries: 2}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if cfg.dataDir == "" {
+		cfg.dataDir = defaultDataDir()
+	}
+	return cfg
+}
+
+// The environment variable that sets the data directory, for deployments that configure things through the environment.
+const dataDirEnv = "GEOBED_DATA_DIR"
+
+// Where the data sets are downloaded to and cached: $GEOBED_DATA_DIR if it's set, otherwise "./geobed-data".
+func defaultDataDir() string {
+	if dir := os.Getenv(dataDirEnv); dir != "" {
+		return dir
+	}
+	return "./geobed-data"
+}
+
+// Returns the path of a file in the data directory. Only the file name of the given path is used (the data set paths include the default directory).
+func (cfg config) dataPath(name string) string {
+	return filepath.Join(cfg.dataDir, filepath.Base(name))
+}
+
+// Clears any optional fields on the city that were not asked to be loaded.
+func (cfg config) trimFields(c *GeobedCity) {
+	if cfg.fields&FieldCityAlt == 0 {
+		c.CityAlt = ""
+	}
+	if cfg.fields&FieldGeohash == 0 {
+		c.Geohash = ""
+	}
+	if cfg.fields&FieldPopulation == 0 {
+		c.Population = 0
+	}
+	if cfg.fields&FieldFeatureCode == 0 {
+		c.FeatureCode = ""
+	}
+	if cfg.fields&FieldTimezone == 0 {
+		c.Timezone = ""
+	}
+	if cfg.fields&FieldElevation == 0 {
+		c.Elevation = 0
+	}
+}
+
+// Returns the configuration to use for a Geocode() call. Without population scoring, ties can't be broken by population either.
+func (cfg config) forGeocode(options GeocodeOptions) config {
+	if options.DisablePopulationScoring && cfg.tieBreak == TieBreakPopulation {
+		cfg.tieBreak = TieBreakSourcePriority
+	}
+	return cfg
+}
+
+// Whether city a should win a tie against city b. The positions of the cities in the data (ai and bi) decide a tie that's left over
+// so that results don't depend on the order candidates were compared in.
+func (cfg config) winsTie(a, b *GeobedCity, ai, bi int) bool {
+	switch cfg.tieBreak {
+	case TieBreakAlphabetical:
+		if a.CityLower != b.CityLower {
+			return a.CityLower < b.CityLower
+		}
+		if a.Country != b.Country {
+			return a.Country < b.Country
+		}
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+	case TieBreakSourcePriority:
+	default:
+		if a.Population != b.Population {
+			return a.Population > b.Population
+		}
+	}
+	return ai < bi
+}
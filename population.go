@@ -0,0 +1,44 @@
+package geobed
+
+import "sort"
+
+// Returns the population of the city nearest to a point (the one ReverseGeocode() returns), ie. for weighting points on a heatmap.
+// Zero if there's no city or its population isn't known.
+func (g *GeoBed) PopulationAt(lat float64, lng float64) int32 {
+	return g.ReverseGeocode(lat, lng).Population
+}
+
+// Returns the total population of the cities within radiusKm of a point, a rough estimate of how many people live in the area.
+// Cities listed by both data sets are only counted once (the larger figure), though people living outside of any city aren't counted at all.
+// Zero for an invalid point or a negative radius.
+func (g *GeoBed) PopulationInRadius(lat float64, lng float64, radiusKm float64) int64 {
+	// Written so a NaN radius is caught too.
+	if checkCoordinate(lat, lng) != nil || !(radiusKm >= 0) {
+		return 0
+	}
+	defer g.rlock()()
+	keys := g.keysWithin(lat, lng, radiusKm)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return g.c[keys[i]].Population > g.c[keys[j]].Population
+	})
+
+	var total int64
+	counted := map[string][]int{}
+	for _, k := range keys {
+		c := g.c[k]
+		id := c.CityLower + "," + c.Country
+		dupe := false
+		for _, ck := range counted[id] {
+			if Distance(c.Latitude, c.Longitude, g.c[ck].Latitude, g.c[ck].Longitude) <= sameCityKm {
+				dupe = true
+				break
+			}
+		}
+		if dupe {
+			continue
+		}
+		counted[id] = append(counted[id], k)
+		total += int64(c.Population)
+	}
+	return total
+}
@@ -0,0 +1,74 @@
+package geobed
+
+import "strings"
+
+// MaxMind region codes that differ from the Geonames admin1 codes for the same region, keyed by country and then by the MaxMind code.
+// MaxMind uses FIPS 10-4 codes, which Geonames also uses for most countries but not these. Used by WithRegionCrosswalk() and can be
+// added to before creating a Geobed (then use PurgeCache() so the data is reloaded with the changes).
+var RegionCrosswalk = map[string]map[string]string{
+	// Belgian provinces to their regions.
+	"BE": {
+		"01": "VLG", "05": "VLG", "08": "VLG", "09": "VLG", "12": "VLG",
+		"03": "WAL", "04": "WAL", "06": "WAL", "07": "WAL", "10": "WAL",
+		"11": "BRU",
+	},
+	// Swiss cantons.
+	"CH": {
+		"01": "AG", "02": "AR", "03": "BL", "04": "BS", "05": "BE", "06": "FR", "07": "GE", "08": "GL", "09": "GR", "10": "AI", "11": "LU", "12": "NE",
+		"13": "NW", "14": "OW", "15": "SG", "16": "SH", "17": "SZ", "18": "SO", "19": "TG", "20": "TI", "21": "UR", "22": "VS", "23": "VD", "24": "ZG",
+		"25": "ZH", "26": "JU",
+	},
+	// French regions from before the 2016 merger to the merged regions.
+	"FR": {
+		"A8": "11",
+		"A3": "24",
+		"A1": "27", "A6": "27",
+		"99": "28", "A7": "28",
+		"B4": "32", "B6": "32",
+		"C1": "44", "A4": "44", "B2": "44",
+		"B5": "52",
+		"A2": "53",
+		"97": "75", "B1": "75", "B7": "75",
+		"A9": "76", "B3": "76",
+		"98": "84", "B9": "84",
+		"B8": "93",
+		"A5": "94",
+	},
+}
+
+// US state FIPS codes and their USPS codes. Some US cities in the MaxMind data set have the numeric FIPS code as their region.
+var usStateFIPSCodes = map[string]string{
+	"01": "AL", "02": "AK", "04": "AZ", "05": "AR", "06": "CA", "08": "CO", "09": "CT", "10": "DE", "11": "DC", "12": "FL",
+	"13": "GA", "15": "HI", "16": "ID", "17": "IL", "18": "IN", "19": "IA", "20": "KS", "21": "KY", "22": "LA", "23": "ME",
+	"24": "MD", "25": "MA", "26": "MI", "27": "MN", "28": "MS", "29": "MO", "30": "MT", "31": "NE", "32": "NV", "33": "NH",
+	"34": "NJ", "35": "NM", "36": "NY", "37": "NC", "38": "ND", "39": "OH", "40": "OK", "41": "OR", "42": "PA", "44": "RI",
+	"45": "SC", "46": "SD", "47": "TN", "48": "TX", "49": "UT", "50": "VT", "51": "VA", "53": "WA", "54": "WV", "55": "WI",
+	"56": "WY", "60": "AS", "66": "GU", "69": "MP", "72": "PR", "78": "VI",
+}
+
+// Returns the USPS code for a US region that's a FIPS code (ie. "TX" for "48"), so US cities from MaxMind match state codes in queries.
+// Anything else is returned as is.
+func usStateCode(region string) string {
+	if sc, ok := usStateFIPSCodes[region]; ok {
+		return sc
+	}
+	return region
+}
+
+// Returns a region code in its canonical form, uppercase (ie. "TX" rather than "tx"). Anything longer than a code is left as is.
+func canonicalRegion(region string) string {
+	region = strings.TrimSpace(region)
+	if len(region) <= 3 {
+		return toUpper(region)
+	}
+	return region
+}
+
+// Returns the Geonames admin1 code for a MaxMind region code (ie. "ZH" for Zürich's "25"). Codes that are the same in both, or that
+// aren't in RegionCrosswalk, are returned as is.
+func GeonamesRegion(country string, region string) string {
+	if r, ok := RegionCrosswalk[toUpper(country)][region]; ok {
+		return r
+	}
+	return region
+}
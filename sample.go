@@ -0,0 +1,75 @@
+package geobed
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+)
+
+// Returns n different cities picked at random (all of them, shuffled, if there aren't that many), ie. for test fixtures or a "random city"
+// feature. When weightByPopulation is true, larger cities are more likely to be picked, in proportion to their population. Cities without
+// a known population are then picked about as often as a city of one person.
+func (g *GeoBed) SampleCities(n int, weightByPopulation bool) []GeobedCity {
+	if n <= 0 {
+		return []GeobedCity{}
+	}
+	defer g.rlock()()
+	if n > len(g.c) {
+		n = len(g.c)
+	}
+
+	var keys []int
+	if weightByPopulation {
+		// Weighted sampling without replacement (Efraimidis and Spirakis), every city gets a random key that's larger for heavier weights
+		// and the n largest keys win. Logs keep the keys from all rounding to 1 with weights in the millions.
+		ws := make(weightedKeys, 0, n+1)
+		for k, v := range g.c {
+			w := math.Max(float64(v.Population), 1)
+			heap.Push(&ws, weightedKey{k: k, key: math.Log(1-rand.Float64()) / w})
+			// Only the n largest are kept, the smallest is on top of the heap.
+			if len(ws) > n {
+				heap.Pop(&ws)
+			}
+		}
+		keys = make([]int, len(ws))
+		for i := range keys {
+			keys[i] = ws[i].k
+		}
+	} else {
+		keys = rand.Perm(len(g.c))[:n]
+	}
+
+	cities := make([]GeobedCity, n)
+	for i, k := range keys {
+		cities[i] = g.c[k]
+	}
+	return cities
+}
+
+// A city's key in the city data and its random sampling key.
+type weightedKey struct {
+	k   int
+	key float64
+}
+
+// A min-heap of weighted keys (see container/heap).
+type weightedKeys []weightedKey
+
+func (w weightedKeys) Len() int {
+	return len(w)
+}
+func (w weightedKeys) Less(i, j int) bool {
+	return w[i].key < w[j].key
+}
+func (w weightedKeys) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+}
+func (w *weightedKeys) Push(x interface{}) {
+	*w = append(*w, x.(weightedKey))
+}
+func (w *weightedKeys) Pop() interface{} {
+	old := *w
+	x := old[len(old)-1]
+	*w = old[:len(old)-1]
+	return x
+}
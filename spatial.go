@@ -0,0 +1,160 @@
+package geobed
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cities (keys in the city data) bucketed by the first few characters of their geohash, so reverse geocoding only has to look at the
+// cities near a point instead of every city. Built (or read from the cache) on first use by buckets() so apps that only forward geocode
+// never pay for it.
+type spatialIndex struct {
+	once sync.Once
+	idx  map[string][]int
+	// The cache to read the buckets from (spatialIdx.dmp), if the cache they were stored in was loaded.
+	fsys fs.FS
+}
+
+// The length of the geohash prefix cities are bucketed by. A bucket is around 150km across.
+const spatialPrefixLen = 3
+
+// The length of the geohash prefix a city has to share with a point to be found by reverse geocoding.
+const reversePrefixLen = 2
+
+func newSpatialIndex() *spatialIndex {
+	return &spatialIndex{}
+}
+
+// Returns the geohash buckets, building them on the first call.
+func (g *GeoBed) buckets() map[string][]int {
+	// A GeoBed that wasn't made by NewGeobed() has no index to keep the buckets in, so just build them each time.
+	if g.spatial == nil {
+		return g.buildBuckets()
+	}
+	g.spatial.once.Do(func() {
+		if g.spatial.fsys != nil {
+			if idx, err := loadGeobedSpatialIdx(g.spatial.fsys, "spatialIdx.dmp"); err == nil {
+				g.spatial.idx = idx
+				return
+			}
+		}
+		g.spatial.idx = g.buildBuckets()
+	})
+	return g.spatial.idx
+}
+
+func (g *GeoBed) buildBuckets() map[string][]int {
+	idx := make(map[string][]int)
+	for k, v := range g.c {
+		if len(v.Geohash) < spatialPrefixLen {
+			continue
+		}
+		p := v.Geohash[:spatialPrefixLen]
+		idx[p] = append(idx[p], k)
+	}
+	return idx
+}
+
+// Reads the buckets stored by store(). Buckets of a different length (from another version) are an error so they get rebuilt.
+func loadGeobedSpatialIdx(fsys fs.FS, name string) (map[string][]int, error) {
+	idx := map[string][]int{}
+	if err := loadGob(fsys, name, &idx); err != nil {
+		return nil, cacheErr(err)
+	}
+	for p := range idx {
+		if len(p) != spatialPrefixLen {
+			return nil, wrapErr(ErrCacheCorrupt, errors.New(name+": geohash prefix "+p+" is the wrong length"))
+		}
+	}
+	return idx, nil
+}
+
+// Returns the keys of the cities in the same bucket as the geohash gh, and separately the other buckets of cities that share its first
+// reversePrefixLen characters (which are further away).
+func (g *GeoBed) reverseCandidates(gh string) ([]int, [][]int) {
+	b := g.buckets()
+	others := [][]int{}
+	for i := range geohashBase32 {
+		if p := gh[:reversePrefixLen] + geohashBase32[i:i+1]; p != gh[:spatialPrefixLen] && len(b[p]) > 0 {
+			others = append(others, b[p])
+		}
+	}
+	return b[gh[:spatialPrefixLen]], others
+}
+
+// Builds the index used for reverse geocoding. It's otherwise built by the first ReverseGeocode() call, which takes a pass over all of
+// the cities (around a second with the full data sets) on top of the lookup itself. Calling this at startup moves that cost out of the
+// first request. Safe to call more than once and from several goroutines.
+func (g *GeoBed) WarmSpatialIndex() {
+	defer g.rlock()()
+	g.buckets()
+}
+
+// Returns every city within a box, ie. a map's viewport, so there's no need to pull all of them to clip them. A box that crosses the
+// antimeridian has a minLng greater than its maxLng (ie. 170 to -170). The cities are in no particular order. Only the geohash buckets
+// overlapping the box are looked in, so cities without a geohash (see WithLoadFields()) aren't found. A limit above 0 returns only that
+// many of the most populous cities, largest first (ie. the 200 biggest cities in the viewport).
+func (g *GeoBed) CitiesInBounds(minLat float64, minLng float64, maxLat float64, maxLng float64, limit int) []GeobedCity {
+	cities := []GeobedCity{}
+	if checkCoordinate(minLat, minLng) != nil || checkCoordinate(maxLat, maxLng) != nil || minLat > maxLat {
+		return cities
+	}
+	defer g.rlock()()
+	box := BoundingBox{MinLat: minLat, MinLng: minLng, MaxLat: maxLat, MaxLng: maxLng}
+	keys := []int{}
+	for p, bucket := range g.buckets() {
+		if !box.overlaps(geohashBox(p)) {
+			continue
+		}
+		for _, k := range bucket {
+			if box.contains(g.c[k].Latitude, g.c[k].Longitude) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	// Each city is in one bucket, so there are no duplicates. Sorting just makes the order the same from one call to the next.
+	sort.Ints(keys)
+	for _, k := range keys {
+		cities = append(cities, g.c[k])
+	}
+	if limit > 0 {
+		cities = largestCities(cities, limit)
+	}
+	return cities
+}
+
+// Returns the keys of the cities within radiusKm of a point, looking only in the geohash buckets that cover the circle. Cities without a
+// geohash (see WithLoadFields()) aren't found.
+func (g *GeoBed) keysWithin(lat float64, lng float64, radiusKm float64) []int {
+	cells := GeohashCellsForRadius(lat, lng, radiusKm)
+	b := g.buckets()
+	keys := []int{}
+	scanned := map[string]bool{}
+	scan := func(p string) {
+		if scanned[p] {
+			return
+		}
+		scanned[p] = true
+		for _, k := range b[p] {
+			if Distance(lat, lng, g.c[k].Latitude, g.c[k].Longitude) <= radiusKm {
+				keys = append(keys, k)
+			}
+		}
+	}
+	for _, cell := range cells {
+		if len(cell) >= spatialPrefixLen {
+			scan(cell[:spatialPrefixLen])
+			continue
+		}
+		// Cells bigger than the buckets cover every bucket starting with them.
+		for p := range b {
+			if strings.HasPrefix(p, cell) {
+				scan(p)
+			}
+		}
+	}
+	return keys
+}
@@ -0,0 +1,142 @@
+package geobed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Downloads any data set that's been changed since it was last downloaded (going by the Last-Modified time of the remote file), then
+// does a full reload of the data and rewrites the cache. Only the changed files are downloaded, but since the data sets are merged together
+// (ie. MaxMind cities that Geonames already has are dropped) all of them are parsed again, which takes as long as NewGeobed() without a
+// cache. Nothing is downloaded or reloaded when everything is current, so it's cheap to run on a schedule. If it fails partway, whatever it
+// had downloaded is downloaded and loaded again by the next Update().
+// Data loaded from an archive (see WithDataArchive()) isn't updated. Lookups from other goroutines carry on with the old data while the new
+// data is loaded, and only wait for it to be swapped in. Updates and reloads run one at a time, another one waits for this one to finish.
+// Only this GeoBed gets the new data, copies of it made before (ie. passed by value) keep the old data.
+func (g *GeoBed) Update() error {
+	if g.cfg.dataArchive != "" {
+		return nil
+	}
+	defer g.reloadLock()()
+	// The Last-Modified times of the data sets that were downloaded, the files are given them once the new data is loaded and stored.
+	replaced := map[string]time.Time{}
+	for _, f := range g.cfg.dataSets() {
+		path := g.cfg.dataPath(f["path"])
+		changed, lm, err := g.cfg.dataSetChanged(f)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if err := g.cfg.replaceFile(f["url"], path); err != nil {
+			return err
+		}
+		// Until then it's dated long ago, so if anything fails (or the process is stopped) the next Update() gets it again and loads it.
+		if err := os.Chtimes(path, notLoaded, notLoaded); err != nil {
+			return err
+		}
+		replaced[path] = lm
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+	if err := g.reload(); err != nil {
+		return err
+	}
+	if err := g.store(); err != nil {
+		return err
+	}
+	// The next check compares against the server's time rather than when it was downloaded.
+	for path, lm := range replaced {
+		if err := os.Chtimes(path, lm, lm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The modification time of a data set that was downloaded by Update() but hasn't been loaded yet.
+var notLoaded = time.Unix(0, 0)
+
+// Whether the remote copy of a data set is newer than the downloaded one (or it hasn't been downloaded), going by the Last-Modified time
+// of the remote file against the downloaded file's modification time. Also returns the Last-Modified time.
+func (cfg config) dataSetChanged(f map[string]string) (bool, time.Time, error) {
+	lm, err := cfg.lastModified(f["url"])
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	fi, err := os.Stat(cfg.dataPath(f["path"]))
+	return err != nil || lm.After(fi.ModTime()), lm, nil
+}
+
+// Reloads the data without restarting. Unless force is set it's the same as Update(), only the data sets that have changed are downloaded
+// and nothing is reloaded if none have. With force, all of them (or the archive, if it's a URL) are downloaded again and the data is reloaded
+// either way, ie. after a data set was damaged. The cache is rewritten. Lookups carry on with the old data until the new data is swapped in,
+// and if anything fails the old data is kept. As with Update(), only this GeoBed is reloaded and one reload runs at a time.
+func (g *GeoBed) ReloadDataSets(force bool) error {
+	if !force {
+		return g.Update()
+	}
+	defer g.reloadLock()()
+	if g.cfg.dataArchive != "" {
+		if path := g.cfg.archivePath(); path != g.cfg.dataArchive {
+			if err := g.cfg.replaceFile(g.cfg.dataArchive, path); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, f := range g.cfg.dataSets() {
+			if err := g.cfg.replaceFile(f["url"], g.cfg.dataPath(f["path"])); err != nil {
+				return err
+			}
+		}
+	}
+	if err := g.reload(); err != nil {
+		return err
+	}
+	return g.store()
+}
+
+// Downloads a file next to the old copy first and then moves it into place, so a failed download doesn't leave the data set missing.
+// Errors are ErrDownloadFailed.
+func (cfg config) replaceFile(url string, path string) error {
+	tmp := path + ".download"
+	if err := cfg.fetchFile(context.Background(), url, tmp); err != nil {
+		return wrapErr(ErrDownloadFailed, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return wrapErr(ErrDownloadFailed, err)
+	}
+	return nil
+}
+
+// Loads the data sets again, replacing what's in memory, and rebuilds the indexes. Everything is loaded into a new GeoBed first so the
+// data is only locked while it's swapped. If the data sets can't be loaded, what's in memory is kept. The caller holds the reload lock.
+func (g *GeoBed) reload() error {
+	ng := GeoBed{cfg: g.cfg, mu: g.mu, spatial: newSpatialIndex(), results: g.results}
+	if err := ng.loadDataSets(); err != nil {
+		return err
+	}
+	// Lookups expect there to be something to look up, as with NewGeobed().
+	if len(ng.c) == 0 || len(ng.co) == 0 {
+		return wrapErr(ErrEmptyData, errors.New("no cities or countries in the data sets"))
+	}
+	ng.indexAltNames()
+	ng.indexCountries()
+
+	if g.mu != nil {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
+	// The settings, the lock and the result cache stay as they are, lookups read the settings without the lock.
+	g.c, g.co, g.sourceDate, g.spatial = ng.c, ng.co, ng.sourceDate, ng.spatial
+	g.cityNameIdx, g.altNameIdx = ng.cityNameIdx, ng.altNameIdx
+	g.countryBoundsIdx, g.countryCapitalIdx, g.regionLargestIdx, g.countryPatterns = ng.countryBoundsIdx, ng.countryCapitalIdx, ng.regionLargestIdx, ng.countryPatterns
+	g.countryIdx, g.countryNameIdx, g.regionNames = ng.countryIdx, ng.countryNameIdx, ng.regionNames
+	g.results.purge()
+	return nil
+}
@@ -0,0 +1,42 @@
+package geobed
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Checks that the loaded data is sane: cities sorted by name, none without a name, geohashes the right length and the city name index
+// pointing inside the city data. Returns an ErrInvalidData error describing the first problem found. Worth calling at startup so a damaged
+// cache (or a bug loading the data) fails loudly instead of giving wrong answers later.
+func (g *GeoBed) Validate() error {
+	defer g.rlock()()
+	if len(g.c) == 0 {
+		return invalidData("no cities loaded")
+	}
+	for k, v := range g.c {
+		if v.City == "" || v.CityLower == "" {
+			return invalidData("city " + strconv.Itoa(k) + " has no name")
+		}
+		if k > 0 && v.CityLower < g.c[k-1].CityLower {
+			return invalidData("cities aren't sorted, " + strconv.Quote(v.CityLower) + " (" + strconv.Itoa(k) + ") comes after " + strconv.Quote(g.c[k-1].CityLower))
+		}
+		// Cities without coordinates have no geohash.
+		if v.Geohash != "" && (len(v.Geohash) != 12 || !validGeohash(v.Geohash)) {
+			return invalidData(strconv.Quote(v.City) + " (" + strconv.Itoa(k) + ") has an invalid geohash " + strconv.Quote(v.Geohash))
+		}
+	}
+	for ik, k := range g.cityNameIdx {
+		if k < 0 || k >= len(g.c) {
+			return invalidData("city name index " + strconv.Quote(ik) + " is out of range (" + strconv.Itoa(k) + " of " + strconv.Itoa(len(g.c)) + " cities)")
+		}
+		// The keys are made from the first byte as a rune, see loadDataSets().
+		if string(g.c[k].CityLower[0]) != ik {
+			return invalidData("city name index " + strconv.Quote(ik) + " points to " + strconv.Quote(g.c[k].CityLower))
+		}
+	}
+	return nil
+}
+
+func invalidData(msg string) error {
+	return wrapErr(ErrInvalidData, errors.New(msg))
+}